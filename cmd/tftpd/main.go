@@ -3,16 +3,29 @@ package main
 import (
 	"../../pkg/tftp"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
 
 	var server tftp.Server
+	// A server that cannot start exits, without the DeInit that would save its
+	// files over those it could not load:
 	if e := server.Init(); e != nil {
-		log.Println(e)
+		log.Fatal(e)
 	}
 	defer server.DeInit()
 
+	// SIGINT and SIGTERM shut down like /shutdown, for DeInit to save the files:
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		log.Println("Received", <-signals)
+		server.Running = false
+	}()
+
 	if e := server.AcceptLoop(); e != nil {
 		log.Println(e)
 	}
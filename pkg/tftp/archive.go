@@ -0,0 +1,372 @@
+package tftp
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ArchiveBackend is a read-only Backend that serves the members of tar and zip
+// archives, each mounted at a directory of its namespace. The members are read
+// in place: those of zip archives through the archive's central directory, and
+// those of tar archives at the offsets indexed when the archive is mounted, so
+// that compressed tar archives, which cannot be read in place, are refused.
+//
+// Archives can be mounted and unmounted while the server runs: an unmounted
+// archive is closed once the downloads in progress are over.
+type ArchiveBackend struct {
+	Archives []ArchiveMount // mounted by Init
+	Root     string         // directory of the archives MountUnder mounts; "" to refuse them
+
+	mutex    sync.RWMutex        // protects archives, and their readers
+	archives map[string]*archive // by mount point
+}
+
+// ArchiveMount tells where an archive is mounted.
+type ArchiveMount struct {
+	Dir     string // directory of the members, "" for the root
+	Archive string // path of the tar or zip file
+}
+
+// archive is a mounted archive.
+type archive struct {
+	ArchiveMount
+	file      *os.File
+	members   map[string]*archiveMember
+	readers   int  // readers that are not closed yet
+	unmounted bool // the file is closed with the last reader
+}
+
+// archiveMember is a regular file of an archive.
+type archiveMember struct {
+	size     int64
+	modified time.Time
+	offset   int64     // of the content of a tar member
+	zip      *zip.File // nil for a tar member
+}
+
+type archiveReader struct {
+	backend   *ArchiveBackend
+	archive   *archive
+	reader    io.Reader
+	blockSize int
+}
+
+func (a *ArchiveBackend) Init() (err error) {
+	a.mutex.Lock()
+	a.archives = make(map[string]*archive)
+	a.mutex.Unlock()
+	for _, mount := range a.Archives {
+		if err = a.Mount(mount.Dir, mount.Archive); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (a *ArchiveBackend) DeInit() (err error) {
+	for _, mount := range a.Mounted() {
+		a.Unmount(mount.Dir)
+	}
+	return
+}
+
+// Mount serves the members of the archive at path under dir.
+func (a *ArchiveBackend) Mount(dir, path string) error {
+	if dir != "" {
+		if err := checkName(dir); err != nil {
+			return err
+		}
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("mounting %v: %w", path, err)
+	}
+	ar := &archive{ArchiveMount: ArchiveMount{dir, path}, file: file}
+	if ar.members, err = indexArchive(file); err != nil {
+		file.Close()
+		return fmt.Errorf("mounting %v: %w", path, err)
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if _, ok := a.archives[dir]; ok {
+		file.Close()
+		return fmt.Errorf("mount point /%v %w", dir, ErrExists)
+	}
+	a.archives[dir] = ar
+	log.Printf("Mounted %v at /%v: %v files\n", path, dir, len(ar.members))
+	return nil
+}
+
+// MountUnder mounts the archive of a path relative to Root, confined to it as
+// the files of a DiskBackend are: for the admin interface, which cannot mount
+// the other files of the host.
+func (a *ArchiveBackend) MountUnder(dir, name string) error {
+	if a.Root == "" {
+		return fmt.Errorf("mounting %v: no archive root: %w", name, ErrAccess)
+	}
+	root, err := filepath.Abs(a.Root)
+	if err == nil {
+		root, err = filepath.EvalSymlinks(root)
+	}
+	if err != nil {
+		return fmt.Errorf("archive root: %w", err)
+	}
+	path, err := confine(root, name)
+	if err != nil {
+		return err
+	}
+	return a.Mount(dir, path)
+}
+
+// Unmount stops serving the archive mounted at dir.
+func (a *ArchiveBackend) Unmount(dir string) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	ar, ok := a.archives[dir]
+	if !ok {
+		return fmt.Errorf("mount point /%v %w", dir, ErrNotFound)
+	}
+	delete(a.archives, dir)
+	ar.unmounted = true
+	if ar.readers == 0 {
+		ar.file.Close()
+	}
+	log.Printf("Unmounted %v from /%v\n", ar.Archive, dir)
+	return nil
+}
+
+// Mounted describes the archives mounted, in no particular order.
+func (a *ArchiveBackend) Mounted() []ArchiveMount {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	mounts := make([]ArchiveMount, 0, len(a.archives))
+	for _, ar := range a.archives {
+		mounts = append(mounts, ar.ArchiveMount)
+	}
+	return mounts
+}
+
+// indexArchive returns the regular files of a zip or uncompressed tar archive,
+// by file name.
+func indexArchive(file *os.File) (map[string]*archiveMember, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	members := make(map[string]*archiveMember)
+	add := func(name string, member *archiveMember) {
+		if name = memberName(name); name != "" {
+			members[name] = member // the last one wins, as when extracting
+		}
+	}
+
+	// Names that lead out of the archive's directory are ignored, rather than
+	// refused with ErrInsecurePath:
+	zr, err := zip.NewReader(file, info.Size())
+	if err == nil || errors.Is(err, zip.ErrInsecurePath) {
+		for _, f := range zr.File {
+			if f.Mode().IsRegular() {
+				add(f.Name, &archiveMember{size: int64(f.UncompressedSize64),
+					modified: f.Modified, zip: f})
+			}
+		}
+		return members, nil
+	}
+	if !errors.Is(err, zip.ErrFormat) {
+		return nil, err
+	}
+
+	magic := make([]byte, 6)
+	n, _ := file.ReadAt(magic, 0)
+	for _, compressed := range [][]byte{{0x1f, 0x8b}, []byte("BZh"), []byte("\xfd7zXZ\x00"),
+		{0x28, 0xb5, 0x2f, 0xfd}} {
+		if bytes.HasPrefix(magic[:n], compressed) {
+			return nil, errors.New("compressed tar archives cannot be read in place")
+		}
+	}
+	// The tar reader seeks past the content of the members: after Next, the
+	// file is at the content of the member.
+	tr := tar.NewReader(file)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return members, nil
+		}
+		if err != nil && !errors.Is(err, tar.ErrInsecurePath) {
+			return nil, fmt.Errorf("not a zip or tar archive: %w", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		offset, err := file.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+		add(hdr.Name, &archiveMember{size: hdr.Size, modified: hdr.ModTime, offset: offset})
+	}
+}
+
+// memberName returns the file name of an archive member, or "" if it is not a
+// valid one.
+func memberName(name string) string {
+	for strings.HasPrefix(name, "./") {
+		name = name[2:]
+	}
+	if checkName(name) != nil {
+		return ""
+	}
+	return name
+}
+
+// lookup returns the archive a file name is in, the one mounted at the
+// longest matching directory, and the name of the member in it.
+func (a *ArchiveBackend) lookup(filename string) (*archive, string) {
+	for dir := filename; ; {
+		dir, _ = splitName(dir)
+		if ar, ok := a.archives[dir]; ok {
+			return ar, strings.TrimPrefix(filename[len(dir):], "/")
+		}
+		if dir == "" {
+			return nil, ""
+		}
+	}
+}
+
+// member returns the member of an archive a file name is.
+func (a *ArchiveBackend) member(filename string) (*archive, *archiveMember, error) {
+	if ar, name := a.lookup(filename); ar != nil {
+		if member, ok := ar.members[name]; ok {
+			return ar, member, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("%v %w", filename, ErrNotFound)
+}
+
+func (a *ArchiveBackend) Stat(filename string) (FileInfo, error) {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	_, member, err := a.member(filename)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return FileInfo{filename, member.size}, nil
+}
+
+// List describes the members of the archives, in no particular order, but for
+// those hidden by an archive mounted over them.
+func (a *ArchiveBackend) List() ([]FileInfo, error) {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	var infos []FileInfo
+	for dir, ar := range a.archives {
+		for name, member := range ar.members {
+			filename := joinName(dir, name)
+			if found, _ := a.lookup(filename); found == ar {
+				infos = append(infos, FileInfo{filename, member.size})
+			}
+		}
+	}
+	return infos, nil
+}
+
+func (a *ArchiveBackend) Browse(prefix, after string, limit int) (Listing, error) {
+	infos, _ := a.List()
+	l := listFiles(infos, prefix, after, limit)
+	if l.Dir != "" && l.Files == 0 {
+		return Listing{}, fmt.Errorf("directory %v %w", l.Dir, ErrNotFound)
+	}
+	return l, nil
+}
+
+func (a *ArchiveBackend) Put(filename string, options PutOptions) (FileWriter, error) {
+	return nil, fmt.Errorf("%v is read-only: %w", filename, ErrAccess)
+}
+
+func (a *ArchiveBackend) Delete(filename string) error {
+	return fmt.Errorf("%v is read-only: %w", filename, ErrAccess)
+}
+
+func (a *ArchiveBackend) Get(filename string, blockSize int) (FileReader, error) {
+	reader, _, err := a.open(filename, blockSize)
+	if err != nil {
+		return nil, err
+	}
+	return reader, nil
+}
+
+// open returns a reader of a member, which keeps its archive open until it is
+// closed.
+func (a *ArchiveBackend) open(filename string, blockSize int) (*archiveReader, *archiveMember, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	ar, member, err := a.member(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	var reader io.Reader
+	if member.zip != nil {
+		if reader, err = member.zip.Open(); err != nil {
+			return nil, nil, fmt.Errorf("reading %v in %v: %w", filename, ar.Archive, err)
+		}
+	} else {
+		reader = io.NewSectionReader(ar.file, member.offset, member.size)
+	}
+	ar.readers++
+	return &archiveReader{a, ar, reader, blockSize}, member, nil
+}
+
+// Metadata gives the modification time of the member, and its digests, read
+// from the archive.
+func (a *ArchiveBackend) Metadata(filename string) (Metadata, error) {
+	r, member, err := a.open(filename, 0)
+	if err != nil {
+		return Metadata{}, err
+	}
+	defer r.Close()
+	sha, md := sha256.New(), md5.New()
+	if _, err = io.Copy(io.MultiWriter(sha, md), r.reader); err != nil {
+		return Metadata{}, fmt.Errorf("reading %v in %v: %w", filename, r.archive.Archive, err)
+	}
+	return Metadata{FileInfo: FileInfo{filename, member.size}, Modified: member.modified,
+		SHA256: hex.EncodeToString(sha.Sum(nil)), MD5: hex.EncodeToString(md.Sum(nil))}, nil
+}
+
+func (r *archiveReader) Read() ([]byte, error) {
+	buf, err := readBlock(r.reader, r.blockSize)
+	if err != nil {
+		return nil, fmt.Errorf("reading %v: %w", r.archive.Archive, err)
+	}
+	return buf, nil
+}
+
+// Close closes the archive, if it was unmounted and this was its last reader.
+func (r *archiveReader) Close() error {
+	if r.archive == nil {
+		return nil
+	}
+	if closer, ok := r.reader.(io.Closer); ok {
+		closer.Close()
+	}
+	r.backend.mutex.Lock()
+	defer r.backend.mutex.Unlock()
+	r.archive.readers--
+	if r.archive.unmounted && r.archive.readers == 0 {
+		r.archive.file.Close()
+	}
+	r.archive = nil
+	return nil
+}
@@ -0,0 +1,220 @@
+package tftp
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeArchive writes a tar or zip archive of files, by the extension of its
+// path: .tar, .tgz or .zip.
+func writeArchive(t *testing.T, path string, files map[string]string) {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	modified := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	if strings.HasSuffix(path, ".zip") {
+		zw := zip.NewWriter(f)
+		for _, name := range names {
+			w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modified})
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.WriteString(w, files[name])
+		}
+		if err = zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	var w io.Writer = f
+	if strings.HasSuffix(path, ".tgz") {
+		gz := gzip.NewWriter(f)
+		defer gz.Close()
+		w = gz
+	}
+	tw := tar.NewWriter(w)
+	tw.WriteHeader(&tar.Header{Name: "./dir/", Typeflag: tar.TypeDir, Mode: 0755})
+	for _, name := range names {
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(files[name])), ModTime: modified}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(tw, files[name])
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testArchive(t *testing.T, ext string) {
+	dir := t.TempDir()
+	big := strings.Repeat("0123456789ABCDEF", 100)
+	files := map[string]string{"./pxelinux.0": big, "boot/vmlinuz": "kernel", "boot/empty": "",
+		"../escape": "x"}
+	writeArchive(t, filepath.Join(dir, "a"+ext), files)
+	writeArchive(t, filepath.Join(dir, "b"+ext), map[string]string{"vmlinuz": "other kernel"})
+
+	a := ArchiveBackend{Archives: []ArchiveMount{{"", filepath.Join(dir, "a"+ext)}}}
+	if err := a.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer a.DeInit()
+	for name, content := range map[string]string{"pxelinux.0": big, "boot/vmlinuz": "kernel",
+		"boot/empty": ""} {
+		if err := getContent(&a, name, content); err != nil {
+			t.Error(name, err)
+		}
+	}
+	for _, name := range []string{"escape", "../escape", "dir", "boot"} {
+		if _, err := a.Get(name, blockSize); !errors.Is(err, ErrNotFound) {
+			t.Errorf("%v: %v", name, err)
+		}
+	}
+	if _, err := a.Put("f", PutOptions{}); !errors.Is(err, ErrAccess) {
+		t.Error(err)
+	}
+	if err := a.Delete("pxelinux.0"); !errors.Is(err, ErrAccess) {
+		t.Error(err)
+	}
+	meta, err := a.Metadata("boot/vmlinuz")
+	if err != nil || meta.Size != 6 || !meta.Modified.Equal(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)) ||
+		meta.MD5 != "50484c19f1afdaf3841a0d821ed393d2" {
+		t.Error(meta, err)
+	}
+
+	// an archive mounted over a directory hides its files:
+	if err := a.Mount("boot", filepath.Join(dir, "b"+ext)); err != nil {
+		t.Fatal(err)
+	}
+	if err := getContent(&a, "boot/vmlinuz", "other kernel"); err != nil {
+		t.Error(err)
+	}
+	if l, err := a.Browse("boot/", "", 0); err != nil || l.Files != 1 || len(l.Entries) != 1 {
+		t.Error(l, err)
+	}
+	if l, err := a.Browse("", "", 0); err != nil || l.Files != 2 || len(l.Entries) != 2 {
+		t.Error(l, err)
+	}
+	if err := a.Mount("boot", filepath.Join(dir, "b"+ext)); !errors.Is(err, ErrExists) {
+		t.Error(err)
+	}
+
+	// an unmounted archive is closed once its downloads are over:
+	reader, err := a.Get("boot/vmlinuz", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = a.Unmount("boot"); err != nil {
+		t.Error(err)
+	}
+	if err = getContent(&a, "boot/vmlinuz", "kernel"); err != nil {
+		t.Error(err)
+	}
+	content := ""
+	for buf, _ := reader.Read(); buf != nil; buf, _ = reader.Read() {
+		content += string(buf)
+	}
+	reader.Close()
+	if content != "other kernel" {
+		t.Error(content)
+	}
+	if err = a.Unmount("boot"); !errors.Is(err, ErrNotFound) {
+		t.Error(err)
+	}
+}
+
+// getContent reads a whole file, and compares it with content.
+func getContent(b Backend, name, content string) error {
+	r, err := b.Get(name, 100)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	read := ""
+	for {
+		buf, err := r.Read()
+		if err != nil {
+			return err
+		}
+		if buf == nil {
+			break
+		}
+		read += string(buf)
+	}
+	if read != content {
+		return errors.New("read " + read)
+	}
+	return nil
+}
+
+func TestArchiveTar(t *testing.T) {
+	testArchive(t, ".tar")
+}
+
+func TestArchiveZip(t *testing.T) {
+	testArchive(t, ".zip")
+}
+
+func TestArchiveFormats(t *testing.T) {
+	dir := t.TempDir()
+	writeArchive(t, filepath.Join(dir, "a.tgz"), map[string]string{"f": "content"})
+	os.WriteFile(filepath.Join(dir, "text"), []byte(strings.Repeat("not an archive\n", 100)), 0644)
+	a := ArchiveBackend{}
+	a.Init()
+	for _, name := range []string{"a.tgz", "text", "missing"} {
+		if err := a.Mount("", filepath.Join(dir, name)); err == nil {
+			t.Error(name, "mounted")
+		}
+	}
+	if len(a.Mounted()) != 0 {
+		t.Error(a.Mounted())
+	}
+}
+
+func TestArchiveMountUnder(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "archives")
+	os.Mkdir(root, 0755)
+	writeArchive(t, filepath.Join(root, "a.zip"), map[string]string{"f": "content"})
+	writeArchive(t, filepath.Join(dir, "secret.zip"), map[string]string{"f": "secret"})
+	os.Symlink("../secret.zip", filepath.Join(root, "link.zip"))
+
+	// without a root, nothing is mounted:
+	a := ArchiveBackend{}
+	a.Init()
+	if err := a.MountUnder("", "a.zip"); !errors.Is(err, ErrAccess) {
+		t.Error(err)
+	}
+
+	// only the archives under the root are:
+	a.Root = root
+	for _, name := range []string{"../secret.zip", filepath.Join(dir, "secret.zip"), "link.zip"} {
+		if err := a.MountUnder("", name); !errors.Is(err, ErrAccess) {
+			t.Errorf("%v: %v", name, err)
+		}
+	}
+	if err := a.MountUnder("boot", "a.zip"); err != nil {
+		t.Fatal(err)
+	}
+	if err := getContent(&a, "boot/f", "content"); err != nil {
+		t.Error(err)
+	}
+	a.DeInit()
+}
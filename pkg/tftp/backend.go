@@ -0,0 +1,111 @@
+package tftp
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+// Backend stores the files the server serves. FileManager is the in-memory
+// implementation, and DiskBackend serves the files of a directory.
+//
+// File names are '/'-separated paths, in directories that Browse lists.
+//
+// Backend errors wrap ErrNotFound, ErrExists, ErrAccess, ErrFull or
+// ErrUnavailable for the server to report them with the matching TFTP error
+// code.
+type Backend interface {
+	Init() error
+	DeInit() error
+
+	// Get opens a file for reading, in blocks of blockSize bytes.
+	Get(filename string, blockSize int) (FileReader, error)
+	// Put creates a file for writing. If the file exists, the overwrite policy
+	// of the options tells if the upload is refused, or where it is stored.
+	Put(filename string, options PutOptions) (FileWriter, error)
+	// Stat describes a file.
+	Stat(filename string) (FileInfo, error)
+	// List describes all the files.
+	List() ([]FileInfo, error)
+	// Browse lists a page of the directory of prefix, up to its last '/': the
+	// entries whose names start with the rest of prefix and come after after,
+	// up to limit of them (0 for no limit).
+	Browse(prefix, after string, limit int) (Listing, error)
+	// Delete removes a file.
+	Delete(filename string) error
+	// Metadata describes a file in detail, as far as the backend knows it.
+	Metadata(filename string) (Metadata, error)
+}
+
+// PutOptions describes an upload to Put.
+type PutOptions struct {
+	Overwrite Overwrite // what to do if the file exists
+	Client    string    // address of the uploader
+}
+
+// FileReader reads a file one block at a time, and returns nil at the end of
+// the file.
+type FileReader interface {
+	Read() ([]byte, error)
+	Close() error
+}
+
+// readBlock reads the next block of a file from r, into a new buffer: the
+// blocks of a window are sent together. The block is size bytes, but for the
+// last one, and nil at the end of the file. The end of the file is where r
+// returns io.EOF: any other error, io.ErrUnexpectedEOF included, is one.
+func readBlock(r io.Reader, size int) ([]byte, error) {
+	buf := make([]byte, size)
+	n := 0
+	for n < size {
+		m, err := r.Read(buf[n:])
+		n += m
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	return buf[:n], nil
+}
+
+// FileWriter writes a file one block at a time. The upload ends with Commit
+// once the whole file is written, or with Abort if the transfer failed.
+type FileWriter interface {
+	Write(buf []byte) error
+	Commit() error
+	Abort() error
+	// Name returns the name the file was stored as by Commit.
+	Name() string
+}
+
+// FileInfo describes a stored file.
+type FileInfo struct {
+	Name string
+	Size int64
+}
+
+// Metadata describes a stored file, and the content it was stored with.
+type Metadata struct {
+	FileInfo
+	Created        time.Time     // when a file was first stored under the name, if known
+	Modified       time.Time     // when this content was stored
+	Uploader       string        `json:",omitempty"` // address of the client that uploaded the content
+	UploadDuration time.Duration `json:",omitempty"`
+	Downloads      int           // downloads of the whole content
+	LastDownload   time.Time     // end of the last of them
+	SHA256         string        // hex digests of the content
+	MD5            string
+}
+
+var (
+	ErrNotFound    = errors.New("not found")
+	ErrExists      = errors.New("already exists")
+	ErrAccess      = errors.New("access violation")
+	ErrFull        = errors.New("storage full")
+	ErrUnavailable = errors.New("unavailable") // the storage failed, for now
+)
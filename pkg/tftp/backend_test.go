@@ -0,0 +1,43 @@
+package tftp
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestReadBlock(t *testing.T) {
+	for _, test := range []struct {
+		content string
+		blocks  []string
+	}{
+		{"", nil},
+		{"0123456789abcdefghij", []string{"01234567", "89abcdef", "ghij"}},
+		{"0123456789abcdef", []string{"01234567", "89abcdef"}},
+	} {
+		// a reader that returns a byte at a time still fills whole blocks:
+		r := iotest.OneByteReader(strings.NewReader(test.content))
+		var blocks []string
+		for {
+			buf, err := readBlock(r, 8)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if buf == nil {
+				break
+			}
+			blocks = append(blocks, string(buf))
+		}
+		if strings.Join(blocks, "|") != strings.Join(test.blocks, "|") {
+			t.Errorf("%q: read %q", test.content, blocks)
+		}
+	}
+
+	// a stream cut short is not the end of the file:
+	r := io.MultiReader(strings.NewReader("012"), iotest.ErrReader(io.ErrUnexpectedEOF))
+	if buf, err := readBlock(r, 8); buf != nil || !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("%q %v", buf, err)
+	}
+}
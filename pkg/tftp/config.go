@@ -3,6 +3,8 @@ package tftp
 import (
 	"fmt"
 	"net"
+	"strings"
+	"time"
 )
 
 type Config struct {
@@ -11,9 +13,38 @@ type Config struct {
 	RequestsLogFileName string
 	LocalInterface      string
 	ListenPort          uint16
-	DataPayloadSize     uint16
+	DataPayloadSize     uint16 // block size of sessions that do not negotiate blksize
+	MaxBlockSize        uint16 // largest blksize the server accepts (RFC 2348)
+	MaxWindowSize       uint16 // largest windowsize the server accepts (RFC 7440)
 	MaxSendTries        uint
-	socketTimeoutSecs   uint
+	BlockRollover       uint16          // block number after 65535, 0 or 1, unless the client negotiates rollover
+	MulticastEnabled    bool            // accept the multicast option (RFC 2090)
+	MulticastAddress    string          // group the DATA packets of multicast reads are sent to
+	MulticastPort       uint16          // port of the first multicast group, the next ones use the next ports
+	MaxFileSize         int64           // largest upload accepted, in bytes; 0 for no limit
+	MemoryBudget        int64           // bytes the in-memory store can hold, uploads in progress included; 0 for no limit
+	EvictLRU            bool            // evict the least recently used files from memory, rather than refuse uploads over MemoryBudget
+	TTL                 time.Duration   // time to live of the files uploaded to memory; 0 for no expiry
+	ExpiryRules         []ExpiryRule    // per file name prefix, the first match overrides TTL
+	ClientQuotaBytes    int64           // bytes a client IP can store, uploads in progress included; 0 for no limit
+	ClientQuotaFiles    int             // files a client IP can store, uploads in progress included; 0 for no limit
+	SnapshotFile        string          // where the in-memory files are saved across restarts; "" for none
+	SnapshotInterval    time.Duration   // between periodic saves of SnapshotFile; 0 to save on shutdown only
+	StorageRoot         string          // directory of the files served; "" keeps them in memory
+	Archives            []ArchiveMount  // without a StorageRoot, archives to serve the members of, read-only
+	ArchiveRoot         string          // directory of the archives /mount can mount, by relative path; "" to refuse them
+	RemapRules          []RemapRule     // rewrite the file names requested, in order
+	RemapFile           string          // more remap rules, applied after RemapRules; "" for none
+	Templates           []TemplateRule  // files generated for each client, rather than read from storage
+	InventoryFile       string          // JSON attributes of the clients for the templates, by IP or other key; "" for none
+	Origin              string          // base HTTP(S) URL the files missing from storage are fetched from; "" for none
+	OriginCacheBytes    int64           // bytes the files fetched from Origin can take in memory; 0 for no limit
+	OriginMaxAge        time.Duration   // the files fetched are served without asking Origin again while younger
+	Overlay             bool            // keep the uploads and deletes in memory, over StorageRoot or Archives left as they are
+	CreateDirectories   bool            // uploads to StorageRoot can create subdirectories
+	Overwrite           Overwrite       // what uploads do to existing files
+	OverwriteRules      []OverwriteRule // per file name prefix, the first match overrides Overwrite
+	SocketTimeout       time.Duration   // retransmission timeout of sessions that do not negotiate one
 }
 
 func (conf *Config) Init() (err error) {
@@ -23,8 +54,37 @@ func (conf *Config) Init() (err error) {
 	conf.LocalInterface = "0.0.0.0"
 	conf.ListenPort = 69
 	conf.DataPayloadSize = 512
+	conf.MaxBlockSize = 65464
+	conf.MaxWindowSize = 64
 	conf.MaxSendTries = 3
-	conf.socketTimeoutSecs = 5
+	conf.BlockRollover = 0
+	conf.MulticastEnabled = false
+	conf.MulticastAddress = "239.255.0.1"
+	conf.MulticastPort = 1758
+	conf.MaxFileSize = 0
+	conf.MemoryBudget = 0
+	conf.EvictLRU = false
+	conf.TTL = 0
+	conf.ExpiryRules = nil
+	conf.ClientQuotaBytes = 0
+	conf.ClientQuotaFiles = 0
+	conf.SnapshotFile = ""
+	conf.SnapshotInterval = time.Minute
+	conf.StorageRoot = ""
+	conf.Archives = nil
+	conf.ArchiveRoot = ""
+	conf.RemapRules = nil
+	conf.RemapFile = ""
+	conf.Templates = nil
+	conf.InventoryFile = ""
+	conf.Origin = ""
+	conf.OriginCacheBytes = 0
+	conf.OriginMaxAge = 0
+	conf.Overlay = false
+	conf.CreateDirectories = false
+	conf.Overwrite = Overwrite{Policy: OverwriteReject}
+	conf.OverwriteRules = nil
+	conf.SocketTimeout = 5 * time.Second
 	return
 }
 
@@ -39,3 +99,25 @@ func (conf *Config) ListenAddr() (*net.UDPAddr, error) {
 		return a, e
 	}
 }
+
+// overwrite returns the overwrite policy of an upload of filename: that of the
+// first rule whose prefix matches, or conf.Overwrite.
+func (conf *Config) overwrite(filename string) Overwrite {
+	for _, rule := range conf.OverwriteRules {
+		if strings.HasPrefix(filename, rule.Prefix) {
+			return rule.Overwrite
+		}
+	}
+	return conf.Overwrite
+}
+
+// ttl returns the time to live of an upload of filename: that of the first
+// rule whose prefix matches, or conf.TTL.
+func (conf *Config) ttl(filename string) time.Duration {
+	for _, rule := range conf.ExpiryRules {
+		if strings.HasPrefix(filename, rule.Prefix) {
+			return rule.TTL
+		}
+	}
+	return conf.TTL
+}
@@ -1 +1,49 @@
 package tftp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConfigOverwrite(t *testing.T) {
+	conf := Config{}
+	conf.Init()
+	conf.OverwriteRules = []OverwriteRule{
+		{"backups/", Overwrite{OverwriteVersions, 7}},
+		{"backups/tmp", Overwrite{Policy: OverwriteReplace}},
+		{"incoming/", Overwrite{Policy: OverwriteRename}},
+	}
+	tests := []struct {
+		filename string
+		policy   OverwritePolicy
+	}{
+		{"boot.img", OverwriteReject},
+		{"backups/router1.cfg", OverwriteVersions},
+		{"backups/tmp1", OverwriteVersions}, // the first rule wins
+		{"incoming/x", OverwriteRename},
+		{"incoming", OverwriteReject},
+	}
+	for _, test := range tests {
+		if o := conf.overwrite(test.filename); o.Policy != test.policy {
+			t.Errorf("%v: expected %v; got %v", test.filename, test.policy, o.Policy)
+		}
+	}
+}
+
+func TestConfigTTL(t *testing.T) {
+	conf := Config{}
+	conf.Init()
+	conf.TTL = time.Hour
+	conf.ExpiryRules = []ExpiryRule{{"scratch/", time.Minute}, {"scratch/keep", 0}, {"boot.img", 0}}
+	tests := map[string]time.Duration{
+		"f":             time.Hour,
+		"scratch/x":     time.Minute,
+		"scratch/keep1": time.Minute, // the first rule wins
+		"boot.img":      0,
+	}
+	for filename, ttl := range tests {
+		if d := conf.ttl(filename); d != ttl {
+			t.Errorf("%v: expected %v; got %v", filename, ttl, d)
+		}
+	}
+}
@@ -0,0 +1,442 @@
+package tftp
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// DiskBackend is a Backend that serves the files under a directory, streamed
+// from and to the disk.
+//
+// File names are paths relative to Root, with '/' separators. Names that are
+// absolute, contain "..", or lead out of Root through a symbolic link, are
+// refused with ErrAccess, and so are the names of staged uploads.
+//
+// Uploads are written to a temporary file next to their destination, which
+// Commit moves to the file name, and Abort removes. The clients that uploaded
+// the files are only known for the uploads since Init.
+type DiskBackend struct {
+	Root              string
+	CreateDirectories bool                              // Put creates the missing directories of a file name
+	Released          func(uploader string, size int64) // called as a file uploaded by a client leaves: deleted or replaced; nil for none
+
+	root      string            // Root, absolute and without symbolic links
+	mutex     sync.Mutex        // protects uploaders
+	uploaders map[string]string // by file name, the clients that uploaded the files
+}
+
+type diskReader struct {
+	file      *os.File
+	blockSize int
+}
+
+type diskWriter struct {
+	backend   *DiskBackend
+	file      *os.File // the temporary file
+	path      string   // the destination
+	name      string   // the file name
+	overwrite Overwrite
+	client    string
+	storedAs  string
+}
+
+// stagedPrefix starts the names of the temporary files of uploads.
+const stagedPrefix = ".tftpd-upload-"
+
+func (d *DiskBackend) Init() (err error) {
+	d.mutex.Lock()
+	d.uploaders = make(map[string]string)
+	d.mutex.Unlock()
+	if err = os.MkdirAll(d.Root, 0755); err != nil {
+		return fmt.Errorf("storage root: %w", err)
+	}
+	if d.root, err = filepath.Abs(d.Root); err != nil {
+		return fmt.Errorf("storage root: %w", err)
+	}
+	if d.root, err = filepath.EvalSymlinks(d.root); err != nil {
+		return fmt.Errorf("storage root: %w", err)
+	}
+	return
+}
+
+func (d *DiskBackend) DeInit() (err error) {
+	return
+}
+
+// resolve returns the path of a file on the disk, if it is under the root.
+func (d *DiskBackend) resolve(filename string) (string, error) {
+	for _, elem := range strings.Split(filename, "/") {
+		if strings.HasPrefix(elem, stagedPrefix) {
+			return "", fmt.Errorf("invalid file name %q: %w", filename, ErrAccess)
+		}
+	}
+	return confine(d.root, filename)
+}
+
+// confine returns the path of a file name under root, an absolute path without
+// symbolic links. Names that are absolute, contain "..", or lead out of root
+// through a symbolic link, are refused with ErrAccess.
+func confine(root, filename string) (string, error) {
+	if err := checkName(filename); err != nil {
+		return "", err
+	}
+	if filepath.IsAbs(filename) {
+		return "", fmt.Errorf("invalid file name %q: %w", filename, ErrAccess)
+	}
+
+	// Follow the symbolic links of the part of the path that exists:
+	existing, rest := filepath.Join(root, filepath.FromSlash(filename)), ""
+	for {
+		real, err := filepath.EvalSymlinks(existing)
+		if err == nil {
+			existing = real
+			break
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", fileError(filename, err)
+		}
+		rest = filepath.Join(filepath.Base(existing), rest)
+		existing = filepath.Dir(existing)
+	}
+	if existing != root && !strings.HasPrefix(existing, root+string(filepath.Separator)) {
+		return "", fmt.Errorf("%v is outside the root: %w", filename, ErrAccess)
+	}
+	return filepath.Join(existing, rest), nil
+}
+
+// fileError wraps the error of a file system operation on filename.
+func fileError(filename string, err error) error {
+	switch {
+	case errors.Is(err, fs.ErrNotExist), errors.Is(err, syscall.ENOTDIR): // a directory is a file
+		return fmt.Errorf("%v %w", filename, ErrNotFound)
+	case errors.Is(err, fs.ErrExist):
+		return fmt.Errorf("%v %w", filename, ErrExists)
+	case errors.Is(err, fs.ErrPermission):
+		return fmt.Errorf("%v: %w", filename, ErrAccess)
+	case errors.Is(err, syscall.ENOSPC), errors.Is(err, syscall.EDQUOT):
+		return fmt.Errorf("%v: %v: %w", filename, err, ErrFull)
+	}
+	return fmt.Errorf("%v: %w", filename, err)
+}
+
+func (d *DiskBackend) Stat(filename string) (FileInfo, error) {
+	p, err := d.resolve(filename)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	info, err := os.Stat(p)
+	if err != nil {
+		return FileInfo{}, fileError(filename, err)
+	}
+	if !info.Mode().IsRegular() {
+		return FileInfo{}, fmt.Errorf("%v %w", filename, ErrNotFound)
+	}
+	return FileInfo{filename, info.Size()}, nil
+}
+
+// List describes the regular files under the root, in lexical order.
+func (d *DiskBackend) List() ([]FileInfo, error) {
+	return d.walk(d.root, "")
+}
+
+// walk describes the regular files under top, the path of the directory dir,
+// and the symbolic links to the regular files that Get serves.
+func (d *DiskBackend) walk(top, dir string) ([]FileInfo, error) {
+	var infos []FileInfo
+	err := filepath.WalkDir(top, func(p string, entry fs.DirEntry, err error) error {
+		link := entry != nil && entry.Type()&fs.ModeSymlink != 0
+		if err != nil || !entry.Type().IsRegular() && !link || strings.HasPrefix(entry.Name(), stagedPrefix) {
+			return err
+		}
+		name, err := filepath.Rel(top, p)
+		if err != nil {
+			return err
+		}
+		name = joinName(dir, filepath.ToSlash(name))
+		if link {
+			if info, err := d.Stat(name); err == nil {
+				infos = append(infos, info)
+			}
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		infos = append(infos, FileInfo{name, info.Size()})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("listing %v: %w", top, err)
+	}
+	return infos, nil
+}
+
+// Browse walks the directory of prefix for the totals of its files: a
+// directory with many files is slow to browse.
+func (d *DiskBackend) Browse(prefix, after string, limit int) (Listing, error) {
+	dir, _ := splitName(prefix)
+	top := d.root
+	if dir != "" {
+		p, err := d.resolve(dir)
+		if err != nil {
+			return Listing{}, err
+		}
+		if info, err := os.Stat(p); err != nil || !info.IsDir() {
+			return Listing{}, fmt.Errorf("directory %v %w", dir, ErrNotFound)
+		}
+		top = p
+	}
+	infos, err := d.walk(top, dir)
+	if err != nil {
+		return Listing{}, err
+	}
+	return listFiles(infos, prefix, after, limit), nil
+}
+
+// Clear refuses to delete the files of Root: /clear only empties the memory.
+func (d *DiskBackend) Clear() error {
+	return fmt.Errorf("the files of %v are not cleared: %w", d.Root, ErrAccess)
+}
+
+func (d *DiskBackend) Delete(filename string) error {
+	info, err := d.Stat(filename)
+	if err != nil {
+		return err
+	}
+	p, err := d.resolve(filename)
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(p); err != nil {
+		return fileError(filename, err)
+	}
+	d.removed(filename, info.Size)
+	return nil
+}
+
+// removed forgets the uploader of a file deleted or replaced, and tells
+// Released.
+func (d *DiskBackend) removed(filename string, size int64) {
+	d.mutex.Lock()
+	uploader, ok := d.uploaders[filename]
+	delete(d.uploaders, filename)
+	d.mutex.Unlock()
+	if ok && d.Released != nil {
+		d.Released(uploader, size)
+	}
+}
+
+// uploaded records the uploader of a file.
+func (d *DiskBackend) uploaded(filename, uploader string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if uploader == "" {
+		delete(d.uploaders, filename)
+	} else {
+		d.uploaders[filename] = uploader
+	}
+}
+
+// rename moves a file over another one, if any, which it reports as removed.
+func (d *DiskBackend) rename(from, to, fromPath, toPath string) error {
+	old, _ := os.Lstat(toPath)
+	if err := os.Rename(fromPath, toPath); err != nil {
+		return err
+	}
+	if old != nil {
+		d.removed(to, old.Size())
+	}
+	if from != "" {
+		d.mutex.Lock()
+		uploader := d.uploaders[from]
+		delete(d.uploaders, from)
+		d.mutex.Unlock()
+		d.uploaded(to, uploader)
+	}
+	return nil
+}
+
+func (d *DiskBackend) Get(filename string, blockSize int) (FileReader, error) {
+	file, err := d.open(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &diskReader{file, blockSize}, nil
+}
+
+// open opens a regular file for reading.
+func (d *DiskBackend) open(filename string) (*os.File, error) {
+	if _, err := d.Stat(filename); err != nil {
+		return nil, err
+	}
+	p, err := d.resolve(filename)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(p)
+	if err != nil {
+		return nil, fileError(filename, err)
+	}
+	return file, nil
+}
+
+func (d *DiskBackend) Put(filename string, options PutOptions) (FileWriter, error) {
+	p, err := d.resolve(filename)
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Dir(p)
+	if _, err = os.Stat(dir); errors.Is(err, fs.ErrNotExist) {
+		if !d.CreateDirectories {
+			return nil, fmt.Errorf("no directory for %v: %w", filename, ErrAccess)
+		}
+		if err = os.MkdirAll(dir, 0755); err != nil {
+			return nil, fileError(filename, err)
+		}
+	}
+	// Fail early if the file already exists and cannot be overwritten:
+	if _, err = os.Lstat(p); err == nil && options.Overwrite.Policy == OverwriteReject {
+		return nil, fmt.Errorf("%v %w", filename, ErrExists)
+	}
+	file, err := os.CreateTemp(dir, stagedPrefix+"*")
+	if err != nil {
+		return nil, fileError(filename, err)
+	}
+	return &diskWriter{backend: d, file: file, path: p, name: filename, overwrite: options.Overwrite,
+		client: options.Client}, nil
+}
+
+// Metadata gives the modification time of the file, and its digests, read from
+// the disk, and the client that uploaded it since Init: the downloads of the
+// files are not recorded.
+func (d *DiskBackend) Metadata(filename string) (Metadata, error) {
+	f, err := d.open(filename)
+	if err != nil {
+		return Metadata{}, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return Metadata{}, fileError(filename, err)
+	}
+	sha, md := sha256.New(), md5.New()
+	if _, err = io.Copy(io.MultiWriter(sha, md), f); err != nil {
+		return Metadata{}, fmt.Errorf("reading %v: %w", f.Name(), err)
+	}
+	d.mutex.Lock()
+	uploader := d.uploaders[filename]
+	d.mutex.Unlock()
+	return Metadata{FileInfo: FileInfo{filename, info.Size()}, Modified: info.ModTime(), Uploader: uploader,
+		SHA256: hex.EncodeToString(sha.Sum(nil)), MD5: hex.EncodeToString(md.Sum(nil))}, nil
+}
+
+func (r *diskReader) Read() ([]byte, error) {
+	buf, err := readBlock(r.file, r.blockSize)
+	if err != nil {
+		return nil, fmt.Errorf("reading %v: %w", r.file.Name(), err)
+	}
+	return buf, nil
+}
+
+func (r *diskReader) Close() error {
+	return r.file.Close()
+}
+
+func (w *diskWriter) Write(buf []byte) error {
+	if _, err := w.file.Write(buf); err != nil {
+		return fileError(w.name, err)
+	}
+	return nil
+}
+
+// Commit moves the temporary file to its destination, as its overwrite policy
+// tells if the file exists: it may have been stored by another upload in the
+// meantime.
+func (w *diskWriter) Commit() error {
+	if err := w.file.Sync(); err != nil {
+		w.Abort()
+		return fileError(w.name, err)
+	}
+	if err := w.file.Close(); err != nil {
+		w.Abort()
+		return fileError(w.name, err)
+	}
+	if err := os.Chmod(w.file.Name(), 0644); err != nil {
+		w.Abort()
+		return fileError(w.name, err)
+	}
+	defer os.Remove(w.file.Name())
+
+	// The names the policy deals with are the file name with a suffix, in the
+	// same directory:
+	path := func(name string) string {
+		return w.path + strings.TrimPrefix(name, w.name)
+	}
+	exists := func(name string) bool {
+		_, err := os.Lstat(path(name))
+		return err == nil
+	}
+	d := w.backend
+	move := func(from, to string) error {
+		if to != "" {
+			return d.rename(from, to, path(from), path(to))
+		}
+		info, err := os.Lstat(path(from))
+		if err == nil {
+			err = os.Remove(path(from))
+		}
+		if err == nil {
+			d.removed(from, info.Size())
+		}
+		return err
+	}
+	for {
+		name, err := w.overwrite.apply(w.name, exists, move)
+		if errors.Is(err, ErrExists) {
+			return err
+		}
+		if err != nil {
+			return fileError(w.name, err)
+		}
+		if name == w.name && w.overwrite.Policy != OverwriteReject {
+			err = d.rename("", name, w.file.Name(), path(name))
+		} else {
+			// A hard link fails if the destination exists, where a rename
+			// would replace it:
+			err = os.Link(w.file.Name(), path(name))
+		}
+		if errors.Is(err, fs.ErrExist) && w.overwrite.Policy == OverwriteRename {
+			continue // another upload took the name in the meantime
+		}
+		if err != nil {
+			return fileError(w.name, err)
+		}
+		d.uploaded(name, w.client)
+		w.storedAs = name
+		return nil
+	}
+}
+
+func (w *diskWriter) Name() string {
+	return w.storedAs
+}
+
+// Abort removes the temporary file.
+func (w *diskWriter) Abort() error {
+	w.file.Close()
+	if err := os.Remove(w.file.Name()); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("removing %v: %w", w.file.Name(), err)
+	}
+	return nil
+}
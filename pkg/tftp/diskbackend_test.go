@@ -0,0 +1,229 @@
+package tftp
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestDiskBackend(t *testing.T) {
+	d := DiskBackend{Root: filepath.Join(t.TempDir(), "root")}
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	if it, err := d.Get("f512", 512); it != nil || !errors.Is(err, ErrNotFound) {
+		t.Error(it, err)
+	}
+	f512 := strings.Repeat("0123456789ABCDEF", 32)
+	if err := putThenGet(&d, "f512", f512); err != nil {
+		t.Error(err)
+	}
+	if err := putThenGet(&d, "f700", f512+f512[:188]); err != nil {
+		t.Error(err)
+	}
+	if _, err := d.Put("f512", PutOptions{}); !errors.Is(err, ErrExists) {
+		t.Error(err)
+	}
+	if info, err := d.Stat("f700"); info.Size != 700 || err != nil {
+		t.Error(info, err)
+	}
+
+	// subdirectories are only created if allowed:
+	if _, err := d.Put("boot/pxe/f1", PutOptions{}); !errors.Is(err, ErrAccess) {
+		t.Error(err)
+	}
+	d.CreateDirectories = true
+	if err := putThenGet(&d, "boot/pxe/f1", "1"); err != nil {
+		t.Error(err)
+	}
+	if _, err := d.Get("boot", 512); !errors.Is(err, ErrNotFound) {
+		t.Error("directories are not files:", err)
+	}
+
+	if infos, err := d.List(); len(infos) != 3 || infos[0].Name != "boot/pxe/f1" || err != nil {
+		t.Error(infos, err)
+	}
+	if err := d.Delete("f512"); err != nil {
+		t.Error(err)
+	}
+	if err := d.Delete("f512"); !errors.Is(err, ErrNotFound) {
+		t.Error(err)
+	}
+
+	// the files of the disk are not cleared:
+	if err := d.Clear(); !errors.Is(err, ErrAccess) {
+		t.Error(err)
+	}
+	if infos, _ := d.List(); len(infos) != 2 {
+		t.Error(infos)
+	}
+}
+
+func TestDiskBackendConfinement(t *testing.T) {
+	dir := t.TempDir()
+	d := DiskBackend{Root: filepath.Join(dir, "root"), CreateDirectories: true}
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "secret"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(dir, filepath.Join(d.Root, "out")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(d.Root, "in"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("in", filepath.Join(d.Root, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"", "../secret", "in/../../secret", "/etc/passwd",
+		"out/secret", "out/new", "out/newdir/new", "a\x00b"} {
+		if _, err := d.Get(name, 512); !errors.Is(err, ErrAccess) {
+			t.Errorf("Get(%q): %v", name, err)
+		}
+		if _, err := d.Put(name, PutOptions{}); !errors.Is(err, ErrAccess) {
+			t.Errorf("Put(%q): %v", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "new")); err == nil {
+		t.Error("a file was created outside the root")
+	}
+
+	// links inside the root are followed:
+	if err := putThenGet(&d, "link/f", "content"); err != nil {
+		t.Error(err)
+	}
+	if info, err := d.Stat("in/f"); info.Size != 7 || err != nil {
+		t.Error(info, err)
+	}
+
+	// the links to the files served are listed, and not the others:
+	if err := os.Symlink("in/f", filepath.Join(d.Root, "f")); err != nil {
+		t.Fatal(err)
+	}
+	os.Symlink("../secret", filepath.Join(d.Root, "secret"))
+	if infos, err := d.List(); len(infos) != 2 || infos[0] != (FileInfo{"f", 7}) ||
+		infos[1] != (FileInfo{"in/f", 7}) || err != nil {
+		t.Error(infos, err)
+	}
+}
+
+func TestFileError(t *testing.T) {
+	for _, errno := range []error{syscall.ENOSPC, syscall.EDQUOT} {
+		err := fileError("f", &fs.PathError{Op: "write", Path: "/srv/f", Err: errno})
+		if !errors.Is(err, ErrFull) || fileErrorCode(err, errAccessViolation) != errDiskFull {
+			t.Error(err)
+		}
+	}
+}
+
+func TestDiskBackendCommit(t *testing.T) {
+	d := DiskBackend{Root: t.TempDir()}
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	entries := func() int {
+		list, _ := os.ReadDir(d.Root)
+		return len(list)
+	}
+
+	// an upload is only visible once committed:
+	w, err := d.Put("f", PutOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("content"))
+	if _, err = d.Stat("f"); !errors.Is(err, ErrNotFound) {
+		t.Error("uncommitted upload is visible:", err)
+	}
+	if infos, _ := d.List(); len(infos) != 0 {
+		t.Error("staged upload is listed:", infos)
+	}
+	w2, err := d.Put("f", PutOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Commit(); err != nil {
+		t.Error(err)
+	}
+	// the first commit wins:
+	if err = w2.Commit(); !errors.Is(err, ErrExists) {
+		t.Error(err)
+	}
+	if info, _ := d.Stat("f"); info.Size != 7 || entries() != 1 {
+		t.Error(info, entries())
+	}
+
+	// an aborted upload leaves nothing behind:
+	w, _ = d.Put("g", PutOptions{})
+	w.Write([]byte("partial"))
+	if err = w.Abort(); err != nil || entries() != 1 {
+		t.Error(err, entries())
+	}
+	if _, err := d.Get(stagedPrefix+"x", 512); !errors.Is(err, ErrAccess) {
+		t.Error("staged uploads cannot be read:", err)
+	}
+}
+
+func TestDiskBackendBrowse(t *testing.T) {
+	d := DiskBackend{Root: t.TempDir(), CreateDirectories: true}
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"f", "boot/a", "boot/pxe/b"} {
+		if err := putThenGet(&d, name, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("boot", filepath.Join(d.Root, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	if root, err := d.Browse("", "", 0); err != nil || root.Files != 3 || len(root.Entries) != 2 ||
+		root.Entries[0] != (ListingEntry{Name: "boot", Dir: true, Size: 16, Files: 2}) {
+		t.Error(root, err)
+	}
+	// the names are those of the directory browsed, through links too:
+	if page, err := d.Browse("link/", "", 1); err != nil || page.Files != 2 || page.Next != "a" ||
+		len(page.Entries) != 1 || page.Entries[0] != (ListingEntry{Name: "a", Size: 6}) {
+		t.Error(page, err)
+	}
+	if page, err := d.Browse("link/", "a", 1); err != nil || page.Next != "" ||
+		len(page.Entries) != 1 || page.Entries[0] != (ListingEntry{Name: "pxe", Dir: true, Size: 10, Files: 1}) {
+		t.Error(page, err)
+	}
+	for _, prefix := range []string{"f/", "none/"} {
+		if _, err := d.Browse(prefix, "", 0); !errors.Is(err, ErrNotFound) {
+			t.Errorf("%q: %v", prefix, err)
+		}
+	}
+	if _, err := d.Browse("../", "", 0); !errors.Is(err, ErrAccess) {
+		t.Error(err)
+	}
+}
+
+func TestDiskBackendMetadata(t *testing.T) {
+	d := DiskBackend{Root: t.TempDir()}
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := upload(&d, "f", "hello world", Overwrite{}); err != nil {
+		t.Fatal(err)
+	}
+	meta, err := d.Metadata("f")
+	if err != nil || meta.Size != 11 || meta.Modified.IsZero() ||
+		meta.SHA256 != "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9" ||
+		meta.MD5 != "5eb63bbbe01eeed093cb22bb8f5acdc3" {
+		t.Error(meta, err)
+	}
+	if _, err := d.Metadata("g"); !errors.Is(err, ErrNotFound) {
+		t.Error(err)
+	}
+}
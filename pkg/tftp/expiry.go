@@ -0,0 +1,66 @@
+package tftp
+
+import (
+	"log"
+	"time"
+)
+
+// ExpiryRule gives a time to live to the files uploaded whose names start with
+// Prefix: a whole file name gives one to that file only.
+type ExpiryRule struct {
+	Prefix string
+	TTL    time.Duration // 0 for no expiry
+}
+
+// expiryInterval is how often a FileManager removes its expired files. They
+// cannot be read once expired, but take their bytes until they are removed,
+// or until the bytes are needed.
+const expiryInterval = 10 * time.Second
+
+func (f *memFile) expired(now time.Time) bool {
+	return !f.expires.IsZero() && !now.Before(f.expires)
+}
+
+// removeExpired removes the expired files that are not being read: the others
+// are removed once their readers are closed.
+func (fm *FileManager) removeExpired() {
+	now := fm.clock()
+	for _, file := range fm.files {
+		if file.readers == 0 && file.expired(now) {
+			log.Printf("Expired %v\n", file.name)
+			fm.discard(file)
+		}
+	}
+}
+
+// evict removes the least recently used files that are not being read, until
+// they free n bytes.
+func (fm *FileManager) evict(n int64) {
+	for e := fm.lru.Back(); e != nil && n > 0; {
+		file := e.Value.(*memFile)
+		e = e.Prev()
+		if file.readers == 0 && len(file.content) > 0 {
+			log.Printf("Evicted %v %vB\n", file.name, len(file.content))
+			n -= int64(len(file.content))
+			fm.discard(file)
+		}
+	}
+}
+
+// expireLoop removes the expired files every expiryInterval, until stop is
+// closed.
+func (fm *FileManager) expireLoop(stop chan struct{}) {
+	defer fm.loops.Done()
+	ticker := time.NewTicker(expiryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			fm.mutex.Lock()
+			fm.removeExpired()
+			fm.mutex.Unlock()
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package tftp
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeClock is the clock of a FileManager in tests.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func TestFileManagerExpiry(t *testing.T) {
+	clock := &fakeClock{time.Unix(0, 0)}
+	ttl := func(filename string) time.Duration {
+		if strings.HasPrefix(filename, "scratch/") {
+			return time.Minute
+		}
+		return 0
+	}
+	fm := FileManager{TTL: ttl, clock: clock.Now}
+	fm.Init()
+	defer fm.DeInit()
+	for _, name := range []string{"scratch/a", "scratch/b", "kept"} {
+		if err := putThenGet(&fm, name, "content"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reader, _ := fm.Get("scratch/b", blockSize)
+
+	clock.now = clock.now.Add(time.Minute)
+	if _, err := fm.Get("scratch/a", blockSize); !errors.Is(err, ErrNotFound) {
+		t.Error("expired file read:", err)
+	}
+	if infos, _ := fm.List(); len(infos) != 1 || infos[0].Name != "kept" {
+		t.Error(infos)
+	}
+	// an expired file can be uploaded again:
+	if _, err := upload(&fm, "scratch/a", "new", Overwrite{}); err != nil {
+		t.Error(err)
+	}
+
+	// the file being read is only removed once its reader is closed:
+	clock.now = clock.now.Add(time.Minute)
+	fm.mutex.Lock()
+	fm.removeExpired()
+	fm.mutex.Unlock()
+	if root, _ := fm.Browse("", "", 0); root.Files != 2 || fm.used != 14 {
+		t.Error(root, fm.used)
+	}
+	reader.Close()
+	fm.mutex.Lock()
+	fm.removeExpired()
+	fm.mutex.Unlock()
+	if root, _ := fm.Browse("", "", 0); root.Files != 1 || fm.used != 7 {
+		t.Error(root, fm.used)
+	}
+}
+
+func TestFileManagerEviction(t *testing.T) {
+	fm := FileManager{Budget: 30, EvictLRU: true}
+	fm.Init()
+	for _, name := range []string{"a", "b", "c"} {
+		if err := putThenGet(&fm, name, "0123456789"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a is the most recently used, and b is being read:
+	fm.Get("a", blockSize)
+	reader, _ := fm.Get("b", blockSize)
+
+	if _, err := upload(&fm, "d", "0123456789", Overwrite{}); err != nil {
+		t.Error(err)
+	}
+	if fm.Exists("c") || !fm.Exists("a") || !fm.Exists("b") {
+		t.Error("expected c to be evicted")
+	}
+	// nothing else can be evicted while b is being read, and d is the most
+	// recently used:
+	if _, err := upload(&fm, "e", strings.Repeat("0123456789", 2), Overwrite{}); !errors.Is(err, ErrFull) {
+		t.Error(err)
+	}
+	reader.Close()
+	if _, err := upload(&fm, "e", strings.Repeat("0123456789", 2), Overwrite{}); err != nil {
+		t.Error(err)
+	}
+	if !fm.Exists("e") || fm.used != 30 {
+		t.Error(fm.List())
+	}
+}
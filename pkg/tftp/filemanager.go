@@ -1,85 +1,533 @@
 package tftp
 
 import (
-	"bytes"
+	"container/list"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"hash"
+	"strings"
+	"sync"
+	"time"
 )
 
+// FileManager is a Backend that keeps the files in memory. It is safe for
+// concurrent use: the content of a file is never modified in place, so that
+// readers hold a snapshot of it for the whole transfer, and uploads are staged
+// until they are committed.
+//
+// The files are indexed by directory, with the totals of the files under each
+// directory kept up to date, for Browse.
+//
+// Files expire after the TTL they are stored with, and the least recently used
+// ones can be evicted to make room for uploads (see expiry.go).
+//
+// With a SnapshotFile, the files are loaded from it by Init, and saved to it
+// by DeInit and every SnapshotInterval, so that they survive a restart.
 type FileManager struct {
-	files map[string][]byte
+	Budget           int64                               // bytes the files and the staged uploads can take; 0 for no limit
+	EvictLRU         bool                                // evict the least recently used files, rather than refuse uploads over Budget
+	TTL              func(filename string) time.Duration // time to live of the files stored, 0 for no expiry; nil for none
+	SnapshotFile     string                              // where the files are saved; "" to keep them in memory only
+	SnapshotInterval time.Duration                       // between periodic saves; 0 to save on DeInit only
+	Released         func(uploader string, size int64)   // called as a file uploaded by a client leaves: deleted, replaced, expired or evicted; nil for none
+
+	mutex   sync.RWMutex // protects files, dirs, lru, used and changes
+	files   map[string]*memFile
+	dirs    map[string]*directory // by name, "" for the root
+	lru     *list.List            // of the files, the most recently used first
+	used    int64                 // bytes taken by the files and the staged uploads
+	changes uint64                // count of the files stored and deleted
+	clock   func() time.Time      // time.Now, unless a test sets it
+
+	saveMutex    sync.Mutex     // serializes the saves
+	savedChanges uint64         // changes when the snapshot was last saved
+	stop         chan struct{}  // closed by DeInit, to stop the loops
+	loops        sync.WaitGroup // saveLoop and expireLoop
+}
+
+// memFile is a file of a FileManager.
+type memFile struct {
+	name    string
+	content []byte
+	meta    Metadata      // without its FileInfo
+	expires time.Time     // zero if the file does not expire
+	readers int           // readers that are not closed yet
+	element *list.Element // in FileManager.lru
+}
+
+// directory is a directory of a FileManager, which exists as long as it holds
+// files.
+type directory struct {
+	entries map[string]bool // names of the files and subdirectories, true for the latter
+	files   int             // in the directory and its subdirectories
+	bytes   int64           // size of these files
 }
 
 type FileIterator struct {
 	fileManager *FileManager
+	file        *memFile // the file being read
 	filename    string
 	blockSize   int
 	position    int
+	content     []byte // snapshot of the file being read, or upload staged so far
+	overwrite   Overwrite
+	client      string
+	started     time.Time
+	sha256, md5 hash.Hash // of the upload staged so far
+	storedAs    string
 }
 
 func (f *FileManager) Init() (err error) {
-	f.files = make(map[string][]byte)
+	f.mutex.Lock()
+	f.files = make(map[string]*memFile)
+	f.dirs = map[string]*directory{"": {entries: make(map[string]bool)}}
+	f.lru = list.New()
+	f.used = 0
+	f.changes, f.savedChanges = 0, 0
+	if f.clock == nil {
+		f.clock = time.Now
+	}
+	f.mutex.Unlock()
+
+	if f.SnapshotFile != "" {
+		if err = f.load(); err != nil {
+			return
+		}
+	}
+	f.stop = make(chan struct{})
+	if f.SnapshotFile != "" && f.SnapshotInterval > 0 {
+		f.loops.Add(1)
+		go f.saveLoop(f.stop)
+	}
+	if f.TTL != nil {
+		f.loops.Add(1)
+		go f.expireLoop(f.stop)
+	}
 	return
 }
 
+// DeInit saves the snapshot.
 func (f *FileManager) DeInit() (err error) {
+	if f.stop != nil {
+		close(f.stop)
+		f.loops.Wait()
+		f.stop = nil
+	}
+	if f.SnapshotFile != "" {
+		err = f.save()
+	}
 	return
 }
+
+// live returns a file, unless it does not exist or expired.
+func (fm *FileManager) live(filename string) (*memFile, bool) {
+	file, ok := fm.files[filename]
+	if !ok || file.expired(fm.clock()) {
+		return nil, false
+	}
+	return file, true
+}
+
 func (fm *FileManager) Exists(filename string) bool {
-	_, ok := fm.files[filename]
+	fm.mutex.RLock()
+	defer fm.mutex.RUnlock()
+	_, ok := fm.live(filename)
 	return ok
 }
 
-func (f *FileManager) MarshalJSON() ([]byte, error) {
-	buffer := bytes.NewBufferString("{")
-	count := 0
-	for fileName, fileContent := range f.files {
-		if count != 0 {
-			buffer.WriteString(",")
+func (fm *FileManager) Stat(filename string) (FileInfo, error) {
+	fm.mutex.RLock()
+	defer fm.mutex.RUnlock()
+	if file, ok := fm.live(filename); ok {
+		return FileInfo{filename, int64(len(file.content))}, nil
+	}
+	return FileInfo{}, fmt.Errorf("%v %w", filename, ErrNotFound)
+}
+
+// List describes the files in no particular order.
+func (fm *FileManager) List() ([]FileInfo, error) {
+	fm.mutex.RLock()
+	defer fm.mutex.RUnlock()
+	now := fm.clock()
+	infos := make([]FileInfo, 0, len(fm.files))
+	for filename, file := range fm.files {
+		if !file.expired(now) {
+			infos = append(infos, FileInfo{filename, int64(len(file.content))})
 		}
-		buffer.WriteString(fmt.Sprintf("\"%s\":%d", fileName, len(fileContent)))
-		count++
 	}
-	buffer.WriteString("}")
-	return buffer.Bytes(), nil
+	return infos, nil
+}
+
+// Clear deletes all the files, for /clear.
+func (fm *FileManager) Clear() error {
+	files, err := fm.List()
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		fm.Delete(file.Name)
+	}
+	return nil
+}
+
+// Delete removes a file. Its readers go on with their snapshots.
+func (fm *FileManager) Delete(filename string) error {
+	fm.mutex.Lock()
+	defer fm.mutex.Unlock()
+	file, ok := fm.files[filename]
+	if !ok {
+		return fmt.Errorf("%v %w", filename, ErrNotFound)
+	}
+	fm.discard(file)
+	return nil
 }
 
-func (fm *FileManager) Get(filename string, readSize int) (file *FileIterator, err error) {
-	if _, ok := fm.files[filename]; ok {
-		return &FileIterator{fm, filename, readSize, 0}, nil
+// rename moves a file to another name, replacing the file of that name.
+func (fm *FileManager) rename(from, to string) error {
+	fm.mutex.Lock()
+	defer fm.mutex.Unlock()
+	file, ok := fm.live(from)
+	if !ok {
+		return fmt.Errorf("%v %w", from, ErrNotFound)
 	}
-	return nil, fmt.Errorf("%v not found", filename)
+	if err := fm.conflict(to); err != nil {
+		return err
+	}
+	fm.remove(from)
+	fm.store(to, file)
+	fm.changes++
+	return nil
+}
 
+// discard deletes a file, and gives its bytes back.
+func (fm *FileManager) discard(file *memFile) {
+	fm.used -= int64(len(file.content))
+	fm.remove(file.name)
+	fm.release(file)
+	fm.changes++
 }
 
-func (fm *FileManager) Put(filename string) (file *FileIterator, err error) {
-	// Fail if the file already exists at the server, we do not handle overwrites:
-	if _, ok := fm.files[filename]; ok {
-		return nil, fmt.Errorf("%v already exists", filename)
+// release tells Released that a file left the store.
+func (fm *FileManager) release(file *memFile) {
+	if fm.Released != nil && file.meta.Uploader != "" {
+		fm.Released(file.meta.Uploader, int64(len(file.content)))
 	}
-	return &FileIterator{fm, filename, -1, -1}, nil
+}
 
+// reserve accounts for n more bytes, unless that exceeds the budget: the
+// expired files, and with EvictLRU the least recently used ones, are removed to
+// make room.
+func (fm *FileManager) reserve(n int64) error {
+	fm.mutex.Lock()
+	defer fm.mutex.Unlock()
+	if fm.Budget > 0 && fm.used+n > fm.Budget {
+		fm.removeExpired()
+		if fm.EvictLRU {
+			fm.evict(fm.used + n - fm.Budget)
+		}
+	}
+	if fm.Budget > 0 && fm.used+n > fm.Budget {
+		return fmt.Errorf("memory budget of %vB exhausted: %w", fm.Budget, ErrFull)
+	}
+	fm.used += n
+	return nil
 }
-func (it *FileIterator) Read() ([]byte, error) {
-	if file, ok := it.fileManager.files[it.filename]; ok {
-		start, end := it.position, it.position+it.blockSize
-		if start >= len(file) {
-			return nil, nil
+
+// memoryUsed returns the bytes taken by the files and the staged uploads.
+func (fm *FileManager) memoryUsed() int64 {
+	fm.mutex.RLock()
+	defer fm.mutex.RUnlock()
+	return fm.used
+}
+
+// free returns the bytes an upload can still take, with the files reserve
+// would remove to make room; -1 if there is no budget.
+func (fm *FileManager) free() int64 {
+	if fm.Budget <= 0 {
+		return -1
+	}
+	fm.mutex.RLock()
+	defer fm.mutex.RUnlock()
+	free, now := fm.Budget-fm.used, fm.clock()
+	for _, file := range fm.files {
+		if file.readers == 0 && (fm.EvictLRU || file.expired(now)) {
+			free += int64(len(file.content))
 		}
-		if end > len(file) {
-			end = len(file)
+	}
+	return free
+}
+
+// store adds or replaces a file, as the most recently used one, and accounts
+// for it in its directories. The file replaced gives its bytes back.
+func (fm *FileManager) store(filename string, file *memFile) {
+	if old, ok := fm.files[filename]; ok {
+		fm.used -= int64(len(old.content))
+		fm.remove(filename)
+		fm.release(old)
+	}
+	file.name = filename
+	fm.files[filename] = file
+	file.element = fm.lru.PushFront(file)
+	content := file.content
+	for name, isDir := filename, false; ; isDir = true {
+		dir, base := splitName(name)
+		d := fm.dirs[dir]
+		if d == nil {
+			d = &directory{entries: make(map[string]bool)}
+			fm.dirs[dir] = d
+		}
+		d.entries[base] = isDir
+		d.files++
+		d.bytes += int64(len(content))
+		if dir == "" {
+			return
+		}
+		name = dir
+	}
+}
+
+// remove deletes a file, and the directories it leaves empty.
+func (fm *FileManager) remove(filename string) {
+	file := fm.files[filename]
+	content := file.content
+	delete(fm.files, filename)
+	fm.lru.Remove(file.element)
+	removed := true // the entry of name goes from its directory
+	for name := filename; ; {
+		dir, base := splitName(name)
+		d := fm.dirs[dir]
+		if removed {
+			delete(d.entries, base)
+		}
+		d.files--
+		d.bytes -= int64(len(content))
+		if dir == "" {
+			return
+		}
+		if removed = d.files == 0; removed {
+			delete(fm.dirs, dir)
 		}
-		it.position = end
-		return file[start:end], nil
+		name = dir
 	}
-	// file was there originally since we got an iterator on it, but
-	// now it's gone
-	return nil, fmt.Errorf("{it.filename} access violation")
 }
 
+// conflict tells why a file cannot be stored as filename: it is a directory,
+// or one of its directories is a file.
+func (fm *FileManager) conflict(filename string) error {
+	if _, ok := fm.dirs[filename]; ok {
+		return fmt.Errorf("%v is a directory: %w", filename, ErrExists)
+	}
+	for dir, _ := splitName(filename); dir != ""; dir, _ = splitName(dir) {
+		if _, ok := fm.files[dir]; ok {
+			return fmt.Errorf("%v is a file: %w", dir, ErrAccess)
+		}
+	}
+	return nil
+}
+
+func (fm *FileManager) Browse(prefix, after string, limit int) (Listing, error) {
+	dir, start := splitName(prefix)
+	fm.mutex.RLock()
+	defer fm.mutex.RUnlock()
+	d, ok := fm.dirs[dir]
+	if !ok {
+		return Listing{}, fmt.Errorf("directory %v %w", dir, ErrNotFound)
+	}
+	l := Listing{Dir: dir, Files: d.files, Bytes: d.bytes}
+	var entries []ListingEntry
+	for name, isDir := range d.entries {
+		if !strings.HasPrefix(name, start) || name <= after {
+			continue
+		}
+		entry := ListingEntry{Name: name, Dir: isDir}
+		if isDir {
+			sub := fm.dirs[joinName(dir, name)]
+			entry.Size, entry.Files = sub.bytes, sub.files
+		} else {
+			entry.Size = int64(len(fm.files[joinName(dir, name)].content))
+		}
+		entries = append(entries, entry)
+	}
+	l.paginate(entries, limit)
+	return l, nil
+}
+
+func (fm *FileManager) Metadata(filename string) (Metadata, error) {
+	fm.mutex.RLock()
+	defer fm.mutex.RUnlock()
+	file, ok := fm.live(filename)
+	if !ok {
+		return Metadata{}, fmt.Errorf("%v %w", filename, ErrNotFound)
+	}
+	meta := file.meta
+	meta.FileInfo = FileInfo{filename, int64(len(file.content))}
+	return meta, nil
+}
+
+// MarshalJSON gives the totals of the files, for the admin status: the admin
+// interface browses the files themselves.
+func (f *FileManager) MarshalJSON() ([]byte, error) {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	root := f.dirs[""]
+	if root == nil {
+		root = &directory{} // not initialized
+	}
+	return []byte(fmt.Sprintf(`{"Files":%d,"Bytes":%d}`, root.files, root.bytes)), nil
+}
+
+// Get returns a reader on a snapshot of the file: changes to the file after
+// Get do not affect it. The file is not evicted until the reader is closed.
+func (fm *FileManager) Get(filename string, readSize int) (file FileReader, err error) {
+	fm.mutex.Lock()
+	defer fm.mutex.Unlock()
+	if f, ok := fm.live(filename); ok {
+		f.readers++
+		fm.lru.MoveToFront(f.element)
+		return &FileIterator{fileManager: fm, file: f, filename: filename, blockSize: readSize,
+			content: f.content}, nil
+	}
+	return nil, fmt.Errorf("%v %w", filename, ErrNotFound)
+
+}
+
+// newFileReader returns a reader on content that is not stored, such as that
+// of a generated file.
+func newFileReader(content []byte, readSize int) FileReader {
+	return &FileIterator{blockSize: readSize, content: content}
+}
+
+func (fm *FileManager) Put(filename string, options PutOptions) (file FileWriter, err error) {
+	if err := checkName(filename); err != nil {
+		return nil, err
+	}
+	fm.mutex.RLock()
+	defer fm.mutex.RUnlock()
+	// Fail early if the file cannot be stored, or already exists and cannot
+	// be overwritten:
+	if err := fm.conflict(filename); err != nil {
+		return nil, err
+	}
+	if _, ok := fm.live(filename); ok && options.Overwrite.Policy == OverwriteReject {
+		return nil, fmt.Errorf("%v %w", filename, ErrExists)
+	}
+	return &FileIterator{fileManager: fm, filename: filename, blockSize: -1, position: -1,
+		overwrite: options.Overwrite, client: options.Client, started: fm.clock(),
+		sha256: sha256.New(), md5: md5.New()}, nil
+
+}
+func (it *FileIterator) Read() ([]byte, error) {
+	file := it.content
+	start, end := it.position, it.position+it.blockSize
+	if start >= len(file) {
+		return nil, nil
+	}
+	if end > len(file) {
+		end = len(file)
+	}
+	it.position = end
+	return file[start:end], nil
+}
+
+// Write appends a block to the staged upload, within the budget, and to its
+// digests.
 func (it *FileIterator) Write(buf []byte) error {
-	//if file, ok := it.fileManager.files[it.filename]; ok {
-	it.fileManager.files[it.filename] = append(it.fileManager.files[it.filename], buf...)
-	//}
+	if err := it.fileManager.reserve(int64(len(buf))); err != nil {
+		return err
+	}
+	it.content = append(it.content, buf...)
+	it.sha256.Write(buf)
+	it.md5.Write(buf)
+	return nil
+}
+
+func (it *FileIterator) Close() error {
+	if it.file != nil {
+		fm := it.fileManager
+		fm.mutex.Lock()
+		it.file.readers--
+		fm.mutex.Unlock()
+		it.file = nil
+	}
+	return nil
+}
+
+// countDownload records that a client received the whole file.
+func (fm *FileManager) countDownload(filename string) {
+	fm.mutex.Lock()
+	defer fm.mutex.Unlock()
+	if file, ok := fm.live(filename); ok {
+		file.meta.Downloads++
+		file.meta.LastDownload = fm.clock()
+		fm.changes++
+	}
+}
+
+// Commit stores the staged upload, as its overwrite policy tells if the file
+// exists: it may have been stored by another upload in the meantime.
+func (it *FileIterator) Commit() error {
+	fm := it.fileManager
+	fm.mutex.Lock()
+	defer fm.mutex.Unlock()
+	exists := func(name string) bool {
+		_, ok := fm.live(name)
+		return ok
+	}
+	move := func(from, to string) error {
+		file := fm.files[from]
+		if to == "" {
+			fm.discard(file)
+			return nil
+		}
+		fm.remove(from)
+		fm.store(to, file)
+		return nil
+	}
+	if err := fm.conflict(it.filename); err != nil {
+		return err
+	}
+	previous, replaced := fm.live(it.filename) // before apply moves it
+	name, err := it.overwrite.apply(it.filename, exists, move)
+	if err != nil {
+		return err
+	}
+	if err = fm.conflict(name); err != nil {
+		return err
+	}
+	if it.content == nil {
+		it.content = []byte{} // an empty file
+	}
+	now := fm.clock()
+	file := &memFile{content: it.content, meta: Metadata{Created: now, Modified: now,
+		Uploader: it.client, UploadDuration: now.Sub(it.started),
+		SHA256: hex.EncodeToString(it.sha256.Sum(nil)), MD5: hex.EncodeToString(it.md5.Sum(nil))}}
+	if replaced && name == it.filename {
+		file.meta.Created = previous.meta.Created
+	}
+	if fm.TTL != nil {
+		if ttl := fm.TTL(name); ttl > 0 {
+			file.expires = now.Add(ttl)
+		}
+	}
+	fm.store(name, file)
+	fm.changes++
+	it.content = nil
+	it.storedAs = name
+	return nil
+}
+
+func (it *FileIterator) Name() string {
+	return it.storedAs
+}
 
+// Abort discards the staged upload.
+func (it *FileIterator) Abort() error {
+	fm := it.fileManager
+	fm.mutex.Lock()
+	fm.used -= int64(len(it.content))
+	fm.mutex.Unlock()
+	it.content = nil
 	return nil
 }
@@ -1,9 +1,11 @@
 package tftp
 
 import (
+	"errors"
 	"fmt"
 	"strings"
 	"testing"
+	"time"
 )
 
 func min(a, b int) int {
@@ -15,8 +17,8 @@ func min(a, b int) int {
 
 const blockSize = 512
 
-func putThenGet(fm *FileManager, name string, content string) error {
-	it, err := fm.Put(name)
+func putThenGet(fm Backend, name string, content string) error {
+	it, err := fm.Put(name, PutOptions{})
 	if it == nil || err != nil {
 		return err
 	}
@@ -27,10 +29,14 @@ func putThenGet(fm *FileManager, name string, content string) error {
 			return err
 		}
 	}
+	if err = it.Commit(); err != nil {
+		return err
+	}
 
 	if it, err := fm.Get(name, blockSize); it == nil || err != nil {
 		return err
 	} else {
+		defer it.Close()
 		content2 := ""
 		for {
 			if buf, err := it.Read(); err != nil {
@@ -72,4 +78,282 @@ func TestFileManager(t *testing.T) {
 	if err := putThenGet(&fm, "f2048", f2048); err != nil {
 		t.Error(err)
 	}
+
+	if info, err := fm.Stat("f2048"); info.Size != 2048 || err != nil {
+		t.Error(info, err)
+	}
+	if _, err := fm.Stat("f4096"); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Error(err)
+	}
+
+	if infos, err := fm.List(); len(infos) != 2 || err != nil {
+		t.Error(infos, err)
+	}
+	if err := fm.Delete("f512"); err != nil || fm.Exists("f512") {
+		t.Error(err)
+	}
+	if err := fm.Delete("f512"); err == nil {
+		t.Error("expected an error deleting a missing file")
+	}
+	if err := fm.Clear(); err != nil || fm.Exists("f2048") {
+		t.Error(err)
+	}
+}
+
+func TestFileManagerSnapshot(t *testing.T) {
+	fm := FileManager{}
+	fm.Init()
+	if err := putThenGet(&fm, "f", "old content"); err != nil {
+		t.Fatal(err)
+	}
+	it, err := fm.Get("f", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ := it.Read()
+
+	// the file is deleted and uploaded again during the download:
+	if err := fm.Delete("f"); err != nil {
+		t.Fatal(err)
+	}
+	if err := putThenGet(&fm, "f", "new"); err != nil {
+		t.Fatal(err)
+	}
+	content := string(first)
+	for buf, err := it.Read(); buf != nil || err != nil; buf, err = it.Read() {
+		if err != nil {
+			t.Fatal(err)
+		}
+		content += string(buf)
+	}
+	if content != "old content" {
+		t.Errorf("read %q", content)
+	}
+}
+
+func TestFileManagerConcurrency(t *testing.T) {
+	fm := FileManager{}
+	fm.Init()
+	done := make(chan error)
+	for i := 0; i < 8; i++ {
+		go func(i int) {
+			name, other := fmt.Sprint("f", i), fmt.Sprint("f", (i+1)%8)
+			var err error
+			for j := 0; j < 50 && err == nil; j++ {
+				err = putThenGet(&fm, name, strings.Repeat(name, 300))
+				if it, e := fm.Get(other, 512); e == nil {
+					for buf, _ := it.Read(); buf != nil; buf, _ = it.Read() {
+					}
+				}
+				fm.Stat(other)
+				fm.List()
+				fm.MarshalJSON()
+				fm.Delete(name)
+			}
+			done <- err
+		}(i)
+	}
+	for i := 0; i < 8; i++ {
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestFileManagerCommit(t *testing.T) {
+	fm := FileManager{}
+	fm.Init()
+
+	// an upload is only visible once committed:
+	w, err := fm.Put("f", PutOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("content"))
+	if fm.Exists("f") {
+		t.Error("uncommitted upload is visible")
+	}
+	w2, err := fm.Put("f", PutOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w2.Write([]byte("other"))
+	if err = w.Commit(); err != nil || !fm.Exists("f") {
+		t.Error(err)
+	}
+	// the first commit wins:
+	if err = w2.Commit(); !errors.Is(err, ErrExists) {
+		t.Error(err)
+	}
+	if info, _ := fm.Stat("f"); info.Size != 7 {
+		t.Error(info)
+	}
+
+	// an aborted upload leaves nothing behind, and can be retried:
+	w, _ = fm.Put("g", PutOptions{})
+	w.Write([]byte("partial"))
+	w.Abort()
+	if fm.Exists("g") {
+		t.Error("aborted upload is visible")
+	}
+	if err := putThenGet(&fm, "g", ""); err != nil || !fm.Exists("g") {
+		t.Error("empty file:", err)
+	}
+}
+
+func TestFileManagerBudget(t *testing.T) {
+	fm := FileManager{Budget: 10}
+	fm.Init()
+
+	if err := putThenGet(&fm, "f", "12345678"); err != nil {
+		t.Fatal(err)
+	}
+	// staged uploads count too:
+	w, _ := fm.Put("g", PutOptions{})
+	if err := w.Write([]byte("12")); err != nil {
+		t.Error(err)
+	}
+	if err := w.Write([]byte("3")); !errors.Is(err, ErrFull) {
+		t.Error("expected the budget to be exhausted; got", err)
+	}
+	w.Abort()
+
+	// deleted and replaced files give their bytes back:
+	if err := fm.Delete("f"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := upload(&fm, "f", "123456789", Overwrite{}); err != nil {
+		t.Error(err)
+	}
+	if err := fm.Delete("f"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := upload(&fm, "f", "12345", Overwrite{Policy: OverwriteReplace}); err != nil {
+			t.Error(err)
+		}
+	}
+	if fm.used != 5 {
+		t.Error("used", fm.used)
+	}
+}
+
+func TestFileManagerDirectories(t *testing.T) {
+	fm := FileManager{}
+	fm.Init()
+	for name, content := range map[string]string{"f": "1", "boot/a": "22", "boot/pxe/b": "333"} {
+		if err := putThenGet(&fm, name, content); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// files and directories do not share names:
+	if _, err := fm.Put("boot", PutOptions{Overwrite: Overwrite{Policy: OverwriteReplace}}); !errors.Is(err, ErrExists) {
+		t.Error(err)
+	}
+	if _, err := fm.Put("f/g", PutOptions{}); !errors.Is(err, ErrAccess) {
+		t.Error(err)
+	}
+	if _, err := fm.Put("boot//c", PutOptions{}); !errors.Is(err, ErrAccess) {
+		t.Error(err)
+	}
+	w, _ := fm.Put("dir", PutOptions{})
+	if err := putThenGet(&fm, "dir/f", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Commit(); !errors.Is(err, ErrExists) {
+		t.Error("stored over a directory:", err)
+	}
+
+	// the totals follow the files stored, versioned and deleted:
+	if _, err := upload(&fm, "boot/pxe/b", "4444", Overwrite{Policy: OverwriteVersions, Versions: 1}); err != nil {
+		t.Error(err)
+	}
+	pxe, err := fm.Browse("boot/pxe/", "", 0)
+	if err != nil || pxe.Files != 2 || pxe.Bytes != 7 || len(pxe.Entries) != 2 ||
+		pxe.Entries[1] != (ListingEntry{Name: "b.~1~", Size: 3}) {
+		t.Error(pxe, err)
+	}
+	if root, _ := fm.Browse("", "", 0); root.Files != 5 || root.Bytes != 10 || len(root.Entries) != 3 ||
+		root.Entries[0] != (ListingEntry{Name: "boot", Dir: true, Size: 9, Files: 3}) {
+		t.Error(root)
+	}
+	for _, name := range []string{"boot/pxe/b", "boot/pxe/b.~1~", "dir/f"} {
+		if err := fm.Delete(name); err != nil {
+			t.Error(err)
+		}
+	}
+	if _, err := fm.Browse("boot/pxe/", "", 0); !errors.Is(err, ErrNotFound) {
+		t.Error("empty directories are removed:", err)
+	}
+	if root, _ := fm.Browse("", "", 0); root.Files != 2 || root.Bytes != 3 || len(root.Entries) != 2 ||
+		root.Entries[0] != (ListingEntry{Name: "boot", Dir: true, Size: 2, Files: 1}) {
+		t.Error(root)
+	}
+	if err := putThenGet(&fm, "dir", "now a file"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFileManagerMetadata(t *testing.T) {
+	clock := &fakeClock{time.Unix(1000, 0)}
+	fm := FileManager{clock: clock.Now}
+	fm.Init()
+
+	w, _ := fm.Put("f", PutOptions{Client: "10.0.0.1:1234"})
+	w.Write([]byte("hello "))
+	clock.now = clock.now.Add(time.Second)
+	w.Write([]byte("world"))
+	if err := w.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	created := clock.now
+	expected := Metadata{FileInfo: FileInfo{"f", 11}, Created: created, Modified: created,
+		Uploader: "10.0.0.1:1234", UploadDuration: time.Second,
+		SHA256: "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9",
+		MD5:    "5eb63bbbe01eeed093cb22bb8f5acdc3"}
+	if meta, err := fm.Metadata("f"); meta != expected || err != nil {
+		t.Error(meta, err)
+	}
+
+	// the downloads the server counts, not the reads:
+	clock.now = clock.now.Add(time.Minute)
+	if err := getThenClose(&fm, "f"); err != nil {
+		t.Error(err)
+	}
+	fm.countDownload("f")
+	if meta, _ := fm.Metadata("f"); meta.Downloads != 1 || !meta.LastDownload.Equal(clock.now) {
+		t.Error(meta)
+	}
+
+	// a new version of a file keeps its creation time:
+	clock.now = clock.now.Add(time.Minute)
+	if _, err := upload(&fm, "f", "new", Overwrite{Policy: OverwriteVersions, Versions: 1}); err != nil {
+		t.Error(err)
+	}
+	if meta, _ := fm.Metadata("f"); !meta.Created.Equal(created) || !meta.Modified.Equal(clock.now) ||
+		meta.Downloads != 0 || meta.Uploader != "" {
+		t.Error(meta)
+	}
+	if meta, _ := fm.Metadata("f.~1~"); meta.Size != 11 || meta.Downloads != 1 {
+		t.Error(meta)
+	}
+	if _, err := fm.Metadata("h"); !errors.Is(err, ErrNotFound) {
+		t.Error(err)
+	}
+}
+
+// getThenClose reads a whole file.
+func getThenClose(b Backend, name string) error {
+	r, err := b.Get(name, blockSize)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	for {
+		buf, err := r.Read()
+		if buf == nil || err != nil {
+			return err
+		}
+	}
 }
@@ -0,0 +1,109 @@
+package tftp
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// File names are '/'-separated paths, relative to the root of the backend: the
+// elements before the last '/' are the directories of the file, which hold
+// files and other directories, as on a disk.
+
+// checkName refuses the file names that are not such paths: empty, absolute,
+// or with empty, "." or ".." elements.
+func checkName(filename string) error {
+	if filename == "" || strings.ContainsRune(filename, 0) {
+		return fmt.Errorf("invalid file name %q: %w", filename, ErrAccess)
+	}
+	for _, elem := range strings.Split(filename, "/") {
+		if elem == "" || elem == "." || elem == ".." {
+			return fmt.Errorf("invalid file name %q: %w", filename, ErrAccess)
+		}
+	}
+	return nil
+}
+
+// splitName returns the directory of a file name, "" for the root, and the
+// name of the file in the directory.
+func splitName(filename string) (dir, name string) {
+	if i := strings.LastIndexByte(filename, '/'); i >= 0 {
+		return filename[:i], filename[i+1:]
+	}
+	return "", filename
+}
+
+// joinName returns the file name of name in the directory dir.
+func joinName(dir, name string) string {
+	if dir == "" {
+		return name
+	}
+	return dir + "/" + name
+}
+
+// Listing is a page of the entries of a directory, as returned by Browse.
+type Listing struct {
+	Dir     string // "" for the root
+	Files   int    // in the directory and its subdirectories
+	Bytes   int64  // size of these files
+	Entries []ListingEntry
+	Next    string `json:",omitempty"` // the last entry, to browse the next page after it; "" on the last page
+}
+
+// ListingEntry is a file of a directory, or a subdirectory with the totals of
+// its files.
+type ListingEntry struct {
+	Name  string // in the directory
+	Dir   bool   `json:",omitempty"`
+	Size  int64  // of the file, or of the files of the directory
+	Files int    `json:",omitempty"` // in the directory and its subdirectories
+}
+
+// paginate sets the entries of the listing, in lexical order, up to limit (0
+// for no limit).
+func (l *Listing) paginate(entries []ListingEntry, limit int) {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	if limit > 0 && len(entries) > limit {
+		entries = entries[:limit]
+		l.Next = entries[limit-1].Name
+	}
+	l.Entries = entries
+}
+
+// listFiles is Browse for a backend that has no index of its directories: it
+// makes the page from the files under the directory of prefix.
+func listFiles(infos []FileInfo, prefix, after string, limit int) Listing {
+	dir, start := splitName(prefix)
+	l := Listing{Dir: dir}
+	under := joinName(dir, "")
+	byName := make(map[string]*ListingEntry)
+	for _, info := range infos {
+		if !strings.HasPrefix(info.Name, under) {
+			continue
+		}
+		l.Files++
+		l.Bytes += info.Size
+		name, isDir := info.Name[len(under):], false
+		if i := strings.IndexByte(name, '/'); i >= 0 {
+			name, isDir = name[:i], true
+		}
+		if !strings.HasPrefix(name, start) || name <= after {
+			continue
+		}
+		entry := byName[name]
+		if entry == nil {
+			entry = &ListingEntry{Name: name, Dir: isDir}
+			byName[name] = entry
+		}
+		entry.Size += info.Size
+		if isDir {
+			entry.Files++
+		}
+	}
+	entries := make([]ListingEntry, 0, len(byName))
+	for _, entry := range byName {
+		entries = append(entries, *entry)
+	}
+	l.paginate(entries, limit)
+	return l
+}
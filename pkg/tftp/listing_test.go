@@ -0,0 +1,52 @@
+package tftp
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestCheckName(t *testing.T) {
+	for _, name := range []string{"f", "boot/pxe/f.0", ".f", "a..b"} {
+		if err := checkName(name); err != nil {
+			t.Error(err)
+		}
+	}
+	for _, name := range []string{"", "/f", "f/", "a//b", "./f", "a/../b", "..", "a\x00b"} {
+		if err := checkName(name); !errors.Is(err, ErrAccess) {
+			t.Errorf("%q: %v", name, err)
+		}
+	}
+}
+
+func TestListFiles(t *testing.T) {
+	infos := []FileInfo{{"f", 1}, {"boot/a", 10}, {"boot/pxe/b", 100}, {"boot/pxe/c", 1000},
+		{"bin", 10000}}
+
+	root := listFiles(infos, "", "", 0)
+	if root.Files != 5 || root.Bytes != 11111 || !reflect.DeepEqual(root.Entries, []ListingEntry{
+		{Name: "bin", Size: 10000}, {Name: "boot", Dir: true, Size: 1110, Files: 3}, {Name: "f", Size: 1}}) {
+		t.Error(root)
+	}
+
+	// a directory, by pages of 1 entry:
+	var names []string
+	for after := ""; ; {
+		page := listFiles(infos, "boot/", after, 1)
+		if page.Dir != "boot" || page.Files != 3 || page.Bytes != 1110 || len(page.Entries) != 1 {
+			t.Fatal(page)
+		}
+		names = append(names, page.Entries[0].Name)
+		if after = page.Next; after == "" {
+			break
+		}
+	}
+	if !reflect.DeepEqual(names, []string{"a", "pxe"}) {
+		t.Error(names)
+	}
+
+	// the rest of the prefix filters the entries:
+	if l := listFiles(infos, "boot/p", "", 0); len(l.Entries) != 1 || l.Entries[0].Name != "pxe" {
+		t.Error(l)
+	}
+}
@@ -0,0 +1,365 @@
+package tftp
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Multicast reads (RFC 2090): clients that read the same file at the same time
+// share a single stream of DATA packets, sent to a multicast group. One of
+// them, the master client, acknowledges the blocks. When it has them all, the
+// server elects the next client as master, and that client acknowledges the
+// blocks it has, so that the server sends it only the ones it missed. Clients
+// that join late are thus filled in, until every client has the whole file.
+//
+// A group keeps the last blocks it read, up to multicastBufferBytes, for the
+// master to resend them: the file is read again from the start for a master
+// that misses earlier blocks.
+
+// multicastBufferBytes is the size of the blocks a multicast group keeps in
+// memory.
+const multicastBufferBytes = 1 << 20
+
+// bitmap is a set of block numbers.
+type bitmap []uint64
+
+func (b *bitmap) set(block uint64) {
+	for uint64(len(*b)) <= block/64 {
+		*b = append(*b, 0)
+	}
+	(*b)[block/64] |= 1 << (block % 64)
+}
+
+func (b bitmap) has(block uint64) bool {
+	return block/64 < uint64(len(b)) && b[block/64]&(1<<(block%64)) != 0
+}
+
+// firstMissing returns the first block number from 1 that is not in the set.
+func (b bitmap) firstMissing() uint64 {
+	block := uint64(1)
+	for b.has(block) {
+		block++
+	}
+	return block
+}
+
+// multicastClient is a client of a multicast group.
+type multicastClient struct {
+	ses      *session
+	received bitmap     // blocks the client acknowledged
+	done     chan error // the outcome of the client's transfer
+}
+
+// multicastGroup sends one file to all the clients that read it in multicast.
+// Its state belongs to the group's goroutine, except for the clients waiting
+// to become master, which are shared with the sessions joining the group.
+type multicastGroup struct {
+	svr       *Server
+	key       string       // the group's entry in Server.multicastGroups
+	sock      *net.UDPConn // unicast socket: OACKs to, and ACKs from, the clients
+	addr      *net.UDPAddr // the multicast group the DATA packets are sent to
+	blockSize int
+	timeout   time.Duration
+	filename  string
+	file      FileReader
+	blocks    [][]byte // the last blocks read, at most window of them
+	first     uint64   // number of blocks[0]
+	window    int
+	lastBlock uint64 // number of the last (short) block, 0 until it is read
+
+	mutex   sync.Mutex
+	waiting []*multicastClient // in order of arrival
+	closed  bool               // the goroutine exited: the group takes no more clients
+}
+
+// negotiateMulticast handles the multicast option (RFC 2090) of a RRQ. The
+// value of the option in the OACK, the group's address and whether the client
+// is the master, is only known when the client joins a group.
+func negotiateMulticast(svr *Server, ses *session, value string) (string, bool, error) {
+	if !svr.Conf.MulticastEnabled || ses.req.Op != OpRRQ || ses.netascii() || ses.generated != nil {
+		return "", false, nil
+	}
+	ses.multicast = true
+	return "", true, nil
+}
+
+// processMulticastRead joins the session to the group reading the file, and
+// waits until the client has received the whole file.
+func (svr *Server) processMulticastRead(ses *session, file FileReader) error {
+	client := &multicastClient{ses: ses, done: make(chan error, 1)}
+	if err := svr.joinMulticastGroup(client, file); err != nil {
+		return err
+	}
+	return <-client.done
+}
+
+// joinMulticastGroup adds a client to the group reading the same file with
+// the same block size and block rollover, or to a new group that reads file. The file is closed
+// by the group, or right away if the group is already reading it.
+func (svr *Server) joinMulticastGroup(client *multicastClient, file FileReader) error {
+	ses := client.ses
+	key := fmt.Sprintf("%v/%v/%v", ses.req.Filename, ses.blockSize, ses.rollover)
+
+	svr.multicastMutex.Lock()
+	defer svr.multicastMutex.Unlock()
+
+	if g := svr.multicastGroups[key]; g != nil {
+		g.mutex.Lock()
+		defer g.mutex.Unlock()
+		if !g.closed {
+			// Until it is elected master, the client only listens to the group:
+			g.sendOAck(client, false)
+			g.waiting = append(g.waiting, client)
+			file.Close()
+			return nil
+		}
+	}
+
+	// Start a new group, on the first free port:
+	port := svr.Conf.MulticastPort
+	for ; svr.multicastPorts[port]; port++ {
+	}
+	addr, err := resolveUDPAddr(svr.Conf.MulticastAddress, port)
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("multicast address: %w", err)
+	}
+	// The group's socket is bound to the local interface: its address selects
+	// the interface the DATA packets are sent on.
+	sock, err := createSessionSocket(svr.Conf.LocalInterface)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	g := &multicastGroup{svr: svr, key: key, sock: sock, addr: addr,
+		blockSize: ses.blockSize, timeout: ses.timeout, filename: ses.req.Filename, file: file,
+		first: 1, window: max(1, multicastBufferBytes/ses.blockSize),
+		waiting: []*multicastClient{client}}
+	if svr.multicastGroups == nil {
+		svr.multicastGroups = make(map[string]*multicastGroup)
+		svr.multicastPorts = make(map[uint16]bool)
+	}
+	svr.multicastGroups[key] = g
+	svr.multicastPorts[port] = true
+	log.Printf("[%v] multicast group %v for %v", sock.LocalAddr(), addr, ses.req.Filename)
+	go g.run()
+	return nil
+}
+
+// run elects the clients as master one after the other, until none is left.
+func (g *multicastGroup) run() {
+	defer g.close()
+	for master := g.nextMaster(); master != nil; master = g.nextMaster() {
+		err := g.serve(master)
+		if err != nil {
+			log.Printf("[%v] multicast master %v dropped: %v", g.sock.LocalAddr(),
+				master.ses.clientAddr, err)
+		}
+		master.done <- err
+	}
+}
+
+// nextMaster removes the first waiting client and returns it, or closes the
+// group if there is none.
+func (g *multicastGroup) nextMaster() *multicastClient {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if len(g.waiting) == 0 {
+		g.closed = true
+		return nil
+	}
+	master := g.waiting[0]
+	g.waiting = g.waiting[1:]
+	return master
+}
+
+func (g *multicastGroup) close() {
+	g.svr.multicastMutex.Lock()
+	if g.svr.multicastGroups[g.key] == g {
+		delete(g.svr.multicastGroups, g.key)
+	}
+	delete(g.svr.multicastPorts, uint16(g.addr.Port))
+	g.svr.multicastMutex.Unlock()
+	g.sock.Close()
+	g.file.Close()
+}
+
+// serve sends the master client the blocks it is missing.
+func (g *multicastGroup) serve(master *multicastClient) error {
+	maxTries := g.svr.Conf.MaxSendTries
+
+	// The master client answers the OACK with the ACK of the last block it
+	// received in sequence, ACK#0 if none:
+	var pkt Packet
+	for tries := uint(0); pkt == nil; tries++ {
+		if tries == maxTries {
+			return fmt.Errorf("no response from client after sending OACK %v times", maxTries)
+		}
+		g.sendOAck(master, true)
+		var err error
+		if pkt, err = g.readFrom(master, g.timeout); err != nil {
+			return err
+		}
+	}
+	if err := g.processAck(master, pkt, 0); err != nil {
+		return err
+	}
+
+	for {
+		next := master.received.firstMissing()
+		if g.lastBlock > 0 && next > g.lastBlock {
+			if counter, ok := g.svr.Files.(downloadCounter); ok {
+				counter.countDownload(g.filename)
+			}
+			log.Println("Done: Sent file", master.ses.req.Filename, "to", master.ses.clientAddr,
+				"in multicast")
+			return nil
+		}
+		data, err := g.block(next)
+		if err != nil {
+			return err
+		}
+		// The block is sent again only when the master does not acknowledge
+		// it in time: the ACKs of earlier blocks are ignored.
+		dataPkt := PacketData{master.ses.wireBlockNumber(next), data}
+		for tries := uint(0); !master.received.has(next); tries++ {
+			if tries == maxTries {
+				return fmt.Errorf("no response from client after sending %v %v times",
+					packetString(&dataPkt), maxTries)
+			}
+			if _, err = g.sock.WriteToUDP(dataPkt.Serialize(), g.addr); err != nil {
+				return fmt.Errorf("writing to %v: %w", g.addr, err)
+			}
+			deadline := time.Now().Add(g.timeout)
+			for !master.received.has(next) {
+				if pkt, err = g.readFrom(master, time.Until(deadline)); err != nil {
+					return err
+				}
+				if pkt == nil {
+					break // timed out: send again
+				}
+				if err = g.processAck(master, pkt, next); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// readFrom returns the next packet from the master client, or nil after
+// timeout. Packets from the other clients of the group are processed on the
+// way: a client that sends an ERROR leaves the group. Invalid packets are
+// ignored.
+func (g *multicastGroup) readFrom(master *multicastClient, timeout time.Duration) (Packet, error) {
+	buf := make([]byte, MaxPacketSize)
+	deadline := time.Now().Add(timeout)
+	for {
+		pkt, addr, err := readPacket(g.sock, buf, time.Until(deadline))
+		if err != nil {
+			return nil, err
+		}
+		if pkt == nil {
+			if addr == nil {
+				return nil, nil // timed out
+			}
+			continue
+		}
+		if addr.String() == master.ses.clientAddr.String() {
+			return *pkt, nil
+		}
+		if pktErr, ok := (*pkt).(*PacketError); ok {
+			g.leave(addr, pktErr)
+		}
+	}
+}
+
+// processAck records the blocks acknowledged by the master client: an ACK
+// means that the client has every block up to its number. near is a block
+// number close to the one acknowledged, to resolve rolled over block numbers.
+func (g *multicastGroup) processAck(master *multicastClient, pkt Packet, near uint64) error {
+	switch p := pkt.(type) {
+	case *PacketAck:
+		ack := int64(near) + blockDistance(p.BlockNum, near, master.ses.rollover)
+		for block := uint64(1); int64(block) <= ack; block++ {
+			master.received.set(block)
+		}
+		return nil
+	case *PacketError:
+		return &clientAbort{p}
+	default:
+		return fmt.Errorf("received %T from the master client", pkt)
+	}
+}
+
+// leave removes a waiting client from the group.
+func (g *multicastGroup) leave(addr *net.UDPAddr, pktErr *PacketError) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	for i, client := range g.waiting {
+		if client.ses.clientAddr.String() == addr.String() {
+			g.waiting = append(g.waiting[:i], g.waiting[i+1:]...)
+			client.done <- &clientAbort{pktErr}
+			return
+		}
+	}
+}
+
+// block returns the content of a block of the file. The file is opened again
+// if the block is before those kept.
+func (g *multicastGroup) block(blockNumber uint64) ([]byte, error) {
+	if blockNumber < g.first {
+		file, err := g.svr.Files.Get(g.filename, g.blockSize)
+		if err != nil {
+			return nil, err
+		}
+		g.file.Close()
+		g.file, g.blocks, g.first = file, nil, 1
+	}
+	for next := g.first + uint64(len(g.blocks)); next <= blockNumber; next++ {
+		if g.lastBlock > 0 && next > g.lastBlock {
+			return nil, fmt.Errorf("block#%v is past the end of the file", blockNumber)
+		}
+		buf, err := g.file.Read()
+		if err != nil {
+			return nil, err
+		}
+		if buf == nil {
+			buf = []byte{} // the file is a multiple of the block size: an empty block ends it
+		}
+		if len(buf) < g.blockSize {
+			g.lastBlock = next
+		}
+		if g.blocks = append(g.blocks, buf); len(g.blocks) > g.window {
+			g.blocks = g.blocks[1:]
+			g.first++
+		}
+	}
+	return g.blocks[blockNumber-g.first], nil
+}
+
+// sendOAck tells a client the multicast group to listen to, and whether it is
+// the master client.
+func (g *multicastGroup) sendOAck(client *multicastClient, master bool) {
+	mc := "0"
+	if master {
+		mc = "1"
+	}
+	value := strings.Join([]string{g.addr.IP.String(), strconv.Itoa(g.addr.Port), mc}, ",")
+	oack := PacketOAck{make([]Option, len(client.ses.oack))}
+	for i, o := range client.ses.oack {
+		if strings.EqualFold(o.Name, "multicast") {
+			o.Value = value
+		}
+		oack.Options[i] = o
+	}
+	if _, err := g.sock.WriteToUDP(oack.Serialize(), client.ses.clientAddr); err != nil {
+		log.Printf("[%v] Could not send OACK to %v: %v", g.sock.LocalAddr(), client.ses.clientAddr, err)
+		return
+	}
+	log.Printf("[%v] Sent %v to %v\n", g.sock.LocalAddr(), oack.String(), client.ses.clientAddr)
+}
@@ -0,0 +1,304 @@
+package tftp
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBitmap(t *testing.T) {
+	var b bitmap
+	if b.has(1) || b.firstMissing() != 1 {
+		t.Error(b)
+	}
+	for _, block := range []uint64{1, 2, 3, 64, 200} {
+		b.set(block)
+	}
+	if !b.has(64) || !b.has(200) || b.has(4) || b.has(1000) || b.firstMissing() != 4 {
+		t.Error(b)
+	}
+}
+
+// readMulticast reads a file from svr as a RFC 2090 client. If started is not
+// nil, it is closed once the client has received firstBlocks blocks.
+func readMulticast(svr *Server, filename string, started chan bool, firstBlocks int) ([]byte, error) {
+	sock, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return nil, err
+	}
+	defer sock.Close()
+	type packet struct {
+		pkt  Packet
+		addr *net.UDPAddr
+	}
+	packets := make(chan packet, 100)
+	receive := func(conn *net.UDPConn) {
+		buf := make([]byte, MaxPacketSize)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if pkt, err := ParsePacket(append([]byte(nil), buf[:n]...)); err == nil {
+				packets <- packet{pkt, addr}
+			}
+		}
+	}
+	go receive(sock)
+
+	req := &PacketRequest{OpRRQ, filename, "octet", []Option{{"blksize", "8"}, {"multicast", ""}}}
+	go svr.processRequest(req, sock.LocalAddr().(*net.UDPAddr))
+
+	var server *net.UDPAddr
+	var group *net.UDPConn
+	master := false
+	blocks := make(map[uint16][]byte)
+	contiguous := func() (n uint16) {
+		for ; blocks[n+1] != nil; n++ {
+		}
+		return n
+	}
+	ack := func() {
+		pkt := PacketAck{contiguous()}
+		sock.WriteToUDP(pkt.Serialize(), server)
+	}
+	for {
+		var p packet
+		select {
+		case p = <-packets:
+		case <-time.After(5 * time.Second):
+			return nil, fmt.Errorf("timed out with %v blocks", contiguous())
+		}
+		switch pkt := p.pkt.(type) {
+		case *PacketOAck:
+			var value string
+			for _, o := range pkt.Options {
+				if o.Name == "multicast" {
+					value = o.Value
+				}
+			}
+			fields := strings.Split(value, ",")
+			if len(fields) != 3 {
+				return nil, fmt.Errorf("invalid multicast option %q", value)
+			}
+			if group == nil {
+				port, _ := strconv.Atoi(fields[1])
+				addr := &net.UDPAddr{IP: net.ParseIP(fields[0]), Port: port}
+				lo, _ := net.InterfaceByName("lo")
+				if group, err = net.ListenMulticastUDP("udp4", lo, addr); err != nil {
+					return nil, err
+				}
+				defer group.Close()
+				go receive(group)
+			}
+			server = p.addr
+			if master = fields[2] == "1"; master {
+				ack()
+			}
+		case *PacketData:
+			if blocks[pkt.BlockNum] == nil {
+				blocks[pkt.BlockNum] = pkt.Data
+			}
+			if started != nil && len(blocks) == firstBlocks {
+				close(started)
+				started = nil
+			}
+			if !master {
+				continue
+			}
+			ack()
+			if last := contiguous(); len(blocks[last]) < 8 {
+				var content []byte
+				for i := uint16(1); i <= last; i++ {
+					content = append(content, blocks[i]...)
+				}
+				return content, nil
+			}
+		case *PacketError:
+			return nil, pkt
+		}
+	}
+}
+
+func TestMulticastBlocks(t *testing.T) {
+	svr := Server{Files: &FileManager{}}
+	svr.Files.Init()
+	if err := putThenGet(svr.Files, "f", "0123456789"); err != nil {
+		t.Fatal(err)
+	}
+	file, _ := svr.Files.Get("f", 4)
+	g := &multicastGroup{svr: &svr, filename: "f", file: file, blockSize: 4, first: 1, window: 2}
+	defer func() { g.file.Close() }()
+
+	// only the last 2 blocks are kept, and the file is read again for the
+	// earlier ones:
+	for _, n := range []int{1, 2, 3, 2, 1, 3} {
+		buf, err := g.block(uint64(n))
+		if expected := "0123456789"[4*(n-1) : min(4*n, 10)]; string(buf) != expected || err != nil {
+			t.Errorf("block#%v: %q %v", n, buf, err)
+		}
+		if len(g.blocks) > 2 {
+			t.Errorf("block#%v: %v blocks kept", n, len(g.blocks))
+		}
+	}
+	if _, err := g.block(4); err == nil {
+		t.Error("block#4 read")
+	}
+}
+
+// serveMaster has a group serve a file of 20 bytes in blocks of 8 to a master
+// client, which sends the packets of noise before the ACK of each block, and
+// returns the DATA packets the group sent.
+func serveMaster(t *testing.T, noise func(block uint16) [][]byte) (int, error) {
+	svr := Server{Conf: &Config{}, Files: &FileManager{}}
+	svr.Conf.Init()
+	svr.Conf.MaxSendTries = 3
+	svr.Files.Init()
+	if err := putThenGet(svr.Files, "f", "0123456789abcdefghij"); err != nil {
+		t.Fatal(err)
+	}
+	listen := func() *net.UDPConn {
+		sock, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sock
+	}
+	client, group := listen(), listen() // the group is a unicast address, for the test
+	defer client.Close()
+	defer group.Close()
+	sock, err := createSessionSocket("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sock.Close()
+	file, _ := svr.Files.Get("f", 8)
+	defer file.Close()
+	g := &multicastGroup{svr: &svr, sock: sock, addr: group.LocalAddr().(*net.UDPAddr), blockSize: 8,
+		timeout: time.Second, filename: "f", file: file, first: 1, window: 10}
+	master := &multicastClient{ses: &session{clientAddr: client.LocalAddr().(*net.UDPAddr),
+		req: &PacketRequest{OpRRQ, "f", "octet", nil}, oack: []Option{{"multicast", ""}}}}
+	served := make(chan error, 1)
+	go func() { served <- g.serve(master) }()
+
+	buf := make([]byte, MaxPacketSize)
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err = client.ReadFromUDP(buf); err != nil { // the OACK
+		return 0, err
+	}
+	client.WriteToUDP((&PacketAck{0}).Serialize(), sock.LocalAddr().(*net.UDPAddr))
+	sent := 0
+	for {
+		group.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := group.ReadFromUDP(buf)
+		if err != nil {
+			return sent, err
+		}
+		sent++
+		pkt, _ := ParsePacket(buf[:n])
+		data := pkt.(*PacketData)
+		for _, b := range noise(data.BlockNum) {
+			client.WriteToUDP(b, sock.LocalAddr().(*net.UDPAddr))
+		}
+		client.WriteToUDP((&PacketAck{data.BlockNum}).Serialize(), sock.LocalAddr().(*net.UDPAddr))
+		if len(data.Data) < 8 {
+			return sent, <-served
+		}
+	}
+}
+
+func TestMulticastInvalidPackets(t *testing.T) {
+	// packets that do not parse are ignored, rather than taken for timeouts:
+	sent, err := serveMaster(t, func(uint16) [][]byte {
+		return [][]byte{[]byte("x"), []byte("x"), []byte("x")}
+	})
+	if sent != 3 || err != nil {
+		t.Error(sent, err)
+	}
+}
+
+func TestMulticastDuplicateAcks(t *testing.T) {
+	// the ACKs of the previous blocks do not have the block sent again, and do
+	// not count as tries:
+	sent, err := serveMaster(t, func(block uint16) [][]byte {
+		ack := (&PacketAck{block - 1}).Serialize()
+		return [][]byte{ack, ack, ack, ack}
+	})
+	if sent != 3 || err != nil {
+		t.Error(sent, err)
+	}
+}
+
+func TestMulticastRollover(t *testing.T) {
+	// the ACKs are numbered with the rollover the master negotiated:
+	g := &multicastGroup{}
+	master := &multicastClient{ses: &session{rollover: 1}}
+	if err := g.processAck(master, &PacketAck{1}, 65535); err != nil || !master.received.has(65536) ||
+		master.received.has(65537) {
+		t.Error(err, master.received.firstMissing())
+	}
+}
+
+func TestMulticastRead(t *testing.T) {
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skip("no loopback interface")
+	}
+	if conn, err := net.ListenMulticastUDP("udp4", lo, &net.UDPAddr{IP: net.IPv4(239, 255, 0, 1)}); err != nil {
+		t.Skip("no multicast on loopback:", err)
+	} else {
+		conn.Close()
+	}
+
+	svr := Server{Conf: &Config{}, Log: &Logger{}, Files: &FileManager{}}
+	svr.Conf.Init()
+	svr.Conf.LocalInterface = "127.0.0.1"
+	svr.Conf.MulticastEnabled = true
+	svr.Conf.MulticastPort = 11758
+	svr.Conf.SocketTimeout = 200 * time.Millisecond
+	svr.Files.Init()
+	content := strings.Repeat("0123456789ABCDEF", 20) + "end"
+	if err := putThenGet(svr.Files, "boot.img", content); err != nil {
+		t.Fatal(err)
+	}
+
+	// the second client joins after the first one received 10 blocks:
+	started := make(chan bool)
+	results := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func(i int) {
+			var signal chan bool
+			if i == 0 {
+				signal = started
+			} else {
+				<-started
+			}
+			received, err := readMulticast(&svr, "boot.img", signal, 10)
+			if err == nil && !bytes.Equal(received, []byte(content)) {
+				err = fmt.Errorf("client %v received %q", i, received)
+			}
+			results <- err
+		}(i)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-results; err != nil {
+			t.Error(err)
+		}
+	}
+
+	// each client counts as a download, once the server got its last ACK:
+	downloads := func() int {
+		meta, _ := svr.Files.Metadata("boot.img")
+		return meta.Downloads
+	}
+	for i := 0; i < 100 && downloads() < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := downloads(); n != 2 {
+		t.Error(n, "downloads")
+	}
+}
@@ -0,0 +1,108 @@
+package tftp
+
+// Transfers in netascii mode (RFC 764, referenced by RFC 1350) convert the
+// file's line endings on the fly: LF is sent as CR LF, and a bare CR as CR NUL.
+// Translation is streamed a block at a time; a CR at the end of a received
+// block is held until the next one tells what it stands for.
+
+// blockReader is the read side of a transfer: it returns the file's content
+// one block at a time, and nil at the end of the file. A FileReader implements it.
+type blockReader interface {
+	Read() ([]byte, error)
+}
+
+// blockWriter is the write side of a transfer. A FileWriter implements it.
+type blockWriter interface {
+	Write([]byte) error
+}
+
+// netasciiReader encodes the content read from src to netascii, in blocks of
+// blockSize bytes.
+type netasciiReader struct {
+	src       blockReader
+	blockSize int
+	pending   []byte // encoded content not returned yet
+	eof       bool
+}
+
+func newNetasciiReader(src blockReader, blockSize int) *netasciiReader {
+	return &netasciiReader{src: src, blockSize: blockSize}
+}
+
+func (r *netasciiReader) Read() ([]byte, error) {
+	for !r.eof && len(r.pending) < r.blockSize {
+		buf, err := r.src.Read()
+		if err != nil {
+			return nil, err
+		}
+		if buf == nil {
+			r.eof = true
+			break
+		}
+		for _, c := range buf {
+			switch c {
+			case '\n':
+				r.pending = append(r.pending, '\r', '\n')
+			case '\r':
+				r.pending = append(r.pending, '\r', 0)
+			default:
+				r.pending = append(r.pending, c)
+			}
+		}
+	}
+	if len(r.pending) == 0 {
+		return nil, nil
+	}
+	n := r.blockSize
+	if n > len(r.pending) {
+		n = len(r.pending)
+	}
+	// the block is copied: the transfer may hold on to it for retransmissions
+	block := append([]byte(nil), r.pending[:n]...)
+	r.pending = r.pending[n:]
+	return block, nil
+}
+
+// netasciiWriter decodes netascii content, and writes it to dst.
+type netasciiWriter struct {
+	dst blockWriter
+	cr  bool // the last block ended with a CR
+}
+
+func newNetasciiWriter(dst blockWriter) *netasciiWriter {
+	return &netasciiWriter{dst: dst}
+}
+
+func (w *netasciiWriter) Write(buf []byte) error {
+	out := make([]byte, 0, len(buf)+1)
+	for _, c := range buf {
+		if w.cr {
+			w.cr = false
+			switch c {
+			case '\n': // CR LF
+				out = append(out, '\n')
+				continue
+			case 0: // CR NUL
+				out = append(out, '\r')
+				continue
+			default: // not netascii, but let's keep the CR rather than drop it
+				out = append(out, '\r')
+			}
+		}
+		if c == '\r' {
+			w.cr = true
+			continue
+		}
+		out = append(out, c)
+	}
+	return w.dst.Write(out)
+}
+
+// Flush writes a CR left pending by the last block.
+func (w *netasciiWriter) Flush() error {
+	if w.cr {
+		w.cr = false
+		return w.dst.Write([]byte{'\r'})
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package tftp
+
+import (
+	"bytes"
+	"testing"
+)
+
+// blocks is a blockReader and a blockWriter over a list of blocks.
+type blocks [][]byte
+
+func (b *blocks) Read() ([]byte, error) {
+	if len(*b) == 0 {
+		return nil, nil
+	}
+	block := (*b)[0]
+	*b = (*b)[1:]
+	return block, nil
+}
+
+func (b *blocks) Write(buf []byte) error {
+	*b = append(*b, append([]byte(nil), buf...))
+	return nil
+}
+
+func TestNetasciiReader(t *testing.T) {
+	tests := []struct {
+		src       blocks
+		blockSize int
+		expected  blocks
+	}{
+		{blocks{[]byte("ab\ncd")}, 512, blocks{[]byte("ab\r\ncd")}},
+		{blocks{[]byte("a\rb")}, 512, blocks{[]byte("a\r\x00b")}},
+		{blocks{[]byte("\n\n"), []byte("\r")}, 2, blocks{[]byte("\r\n"), []byte("\r\n"), []byte("\r\x00")}},
+		{blocks{[]byte("abc\n")}, 4, blocks{[]byte("abc\r"), []byte("\n")}},
+		{blocks{[]byte("ab"), []byte("cd")}, 4, blocks{[]byte("abcd")}},
+		{blocks{}, 512, nil},
+	}
+	for _, test := range tests {
+		r := newNetasciiReader(&test.src, test.blockSize)
+		var actual blocks
+		for {
+			block, err := r.Read()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if block == nil {
+				break
+			}
+			actual = append(actual, block)
+		}
+		if len(actual) != len(test.expected) {
+			t.Errorf("expected %q; got %q", test.expected, actual)
+			continue
+		}
+		for i := range actual {
+			if !bytes.Equal(actual[i], test.expected[i]) {
+				t.Errorf("expected %q; got %q", test.expected, actual)
+			}
+		}
+	}
+}
+
+func TestNetasciiWriter(t *testing.T) {
+	tests := []struct {
+		src      blocks
+		expected string
+	}{
+		{blocks{[]byte("ab\r\ncd")}, "ab\ncd"},
+		{blocks{[]byte("a\r\x00b")}, "a\rb"},
+		{blocks{[]byte("ab\r"), []byte("\ncd")}, "ab\ncd"},
+		{blocks{[]byte("ab\r"), []byte("\x00")}, "ab\r"},
+		{blocks{[]byte("ab\r"), []byte("\r\n")}, "ab\r\n"},
+		{blocks{[]byte("ab\r")}, "ab\r"},
+		{blocks{[]byte("a\rb")}, "a\rb"},
+	}
+	for _, test := range tests {
+		var dst blocks
+		w := newNetasciiWriter(&dst)
+		for _, block := range test.src {
+			if err := w.Write(block); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if actual := bytes.Join(dst, nil); string(actual) != test.expected {
+			t.Errorf("decoding %q: expected %q; got %q", test.src, test.expected, actual)
+		}
+	}
+}
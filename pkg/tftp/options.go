@@ -0,0 +1,168 @@
+package tftp
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// optionHandler validates the value of a requested option and applies it to
+// the session. It returns the value to acknowledge in the OACK, or ok=false if
+// the server ignores the option. An error refuses the whole request.
+type optionHandler func(svr *Server, ses *session, value string) (ack string, ok bool, err error)
+
+// optionHandlers are the options supported by the server, by lowercase name.
+var optionHandlers = map[string]optionHandler{
+	"blksize":    negotiateBlockSize,
+	"tsize":      negotiateTransferSize,
+	"timeout":    negotiateTimeout,
+	"utimeout":   negotiateMicroTimeout,
+	"windowsize": negotiateWindowSize,
+	"rollover":   negotiateRollover,
+	"multicast":  negotiateMulticast,
+}
+
+// negotiate applies the options of the session's request with the given
+// handlers, usually optionHandlers, and records the ones accepted in ses.oack
+// (RFC 2347). Unknown options are ignored, and so are repeated ones.
+func (svr *Server) negotiate(ses *session, handlers map[string]optionHandler) error {
+	seen := make(map[string]bool)
+	for _, o := range ses.req.Options {
+		name := strings.ToLower(o.Name)
+		handler, ok := handlers[name]
+		if !ok || seen[name] {
+			continue
+		}
+		seen[name] = true
+		ack, ok, err := handler(svr, ses, o.Value)
+		if err != nil {
+			return asPacketError(err, errOptionNegotiation)
+		}
+		if ok {
+			ses.oack = append(ses.oack, Option{o.Name, ack})
+		}
+	}
+	return nil
+}
+
+// asPacketError returns err as the ERROR packet to send to the client:
+// either err itself if it is a *PacketError, or err's message with the given code.
+func asPacketError(err error, code uint16) *PacketError {
+	var pktErr *PacketError
+	if errors.As(err, &pktErr) {
+		return pktErr
+	}
+	return &PacketError{code, err.Error()}
+}
+
+// negotiateBlockSize handles the blksize option (RFC 2348): the client asks for
+// a block size, and the server may answer with a smaller one. The server
+// clamps it to Config.MaxBlockSize, and to what fits in a datagram on the
+// session's network path.
+func negotiateBlockSize(svr *Server, ses *session, value string) (string, bool, error) {
+	size, err := strconv.Atoi(value)
+	if err != nil || size < 8 || size > 65464 {
+		return "", false, &PacketError{errOptionNegotiation,
+			fmt.Sprintf("invalid blksize %q", value)}
+	}
+	if size > int(svr.Conf.MaxBlockSize) {
+		size = int(svr.Conf.MaxBlockSize)
+	}
+	if pathSize, err := pathBlockSize(ses.sock, ses.clientAddr); err != nil {
+		log.Printf("[%v] blksize not clamped to path MTU: %v", ses.sock.LocalAddr(), err)
+	} else if size > pathSize {
+		size = pathSize
+	}
+	ses.blockSize = size
+	return strconv.Itoa(size), true, nil
+}
+
+// negotiateTransferSize handles the tsize option (RFC 2349). In a RRQ, the
+// client sends 0 and the server answers with the size of the file. In a WRQ,
+// the client declares the size of the upload, which the server refuses
+// up-front if it cannot store it.
+func negotiateTransferSize(svr *Server, ses *session, value string) (string, bool, error) {
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size < 0 {
+		return "", false, &PacketError{errOptionNegotiation,
+			fmt.Sprintf("invalid tsize %q", value)}
+	}
+	switch ses.req.Op {
+	case OpRRQ:
+		if ses.netascii() {
+			return "", false, nil // the size after conversion is not known in advance
+		}
+		if ses.generated != nil {
+			return strconv.Itoa(len(ses.generated)), true, nil
+		}
+		info, err := svr.Files.Stat(ses.req.Filename)
+		if err != nil {
+			return "", false, nil // the missing file is reported by the read request itself
+		}
+		return strconv.FormatInt(info.Size, 10), true, nil
+	case OpWRQ:
+		if err = svr.checkTransferSize(ses.clientAddr.IP.String(), size); err != nil {
+			return "", false, err
+		}
+		return value, true, nil
+	}
+	return "", false, nil
+}
+
+// negotiateTimeout handles the timeout option (RFC 2349), in seconds. The
+// server acknowledges the value as is, and uses it as the session's
+// retransmission timeout.
+func negotiateTimeout(svr *Server, ses *session, value string) (string, bool, error) {
+	return setTimeout(ses, value, 1, 255, time.Second)
+}
+
+// negotiateMicroTimeout handles the utimeout extension: same as the timeout
+// option, but in microseconds.
+func negotiateMicroTimeout(svr *Server, ses *session, value string) (string, bool, error) {
+	// valid range as implemented by tftp-hpa:
+	return setTimeout(ses, value, 10000, 255000000, time.Microsecond)
+}
+
+func setTimeout(ses *session, value string, min, max int64, unit time.Duration) (string, bool, error) {
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < min || n > max {
+		return "", false, &PacketError{errOptionNegotiation,
+			fmt.Sprintf("invalid timeout %q", value)}
+	}
+	ses.timeout = time.Duration(n) * unit
+	return value, true, nil
+}
+
+// negotiateWindowSize handles the windowsize option (RFC 7440): the number of
+// blocks sent before waiting for an ACK. The server may answer with a smaller
+// one, up to Config.MaxWindowSize.
+func negotiateWindowSize(svr *Server, ses *session, value string) (string, bool, error) {
+	size, err := strconv.Atoi(value)
+	if err != nil || size < 1 || size > 65535 {
+		return "", false, &PacketError{errOptionNegotiation,
+			fmt.Sprintf("invalid windowsize %q", value)}
+	}
+	if size > int(svr.Conf.MaxWindowSize) {
+		size = int(svr.Conf.MaxWindowSize)
+	}
+	ses.windowSize = size
+	return strconv.Itoa(size), true, nil
+}
+
+// negotiateRollover handles the rollover option, a de-facto extension: the
+// block number that follows block#65535, 0 or 1.
+func negotiateRollover(svr *Server, ses *session, value string) (string, bool, error) {
+	switch value {
+	case "0":
+		ses.rollover = 0
+	case "1":
+		ses.rollover = 1
+	default:
+		return "", false, &PacketError{errOptionNegotiation,
+			fmt.Sprintf("invalid rollover %q", value)}
+	}
+	return value, true, nil
+}
@@ -0,0 +1,211 @@
+package tftp
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestNegotiate(t *testing.T) {
+	handlers := make(map[string]optionHandler)
+	handlers["test"] = func(svr *Server, ses *session, value string) (string, bool, error) {
+		switch value {
+		case "ignore":
+			return "", false, nil
+		case "refuse":
+			return "", false, &PacketError{errOptionNegotiation, "refused"}
+		}
+		return value + "!", true, nil
+	}
+
+	svr := Server{}
+	ses := session{req: &PacketRequest{OpRRQ, "foo", "octet",
+		[]Option{{"unknown", "1"}, {"Test", "yes"}, {"test", "again"}}}}
+	if err := svr.negotiate(&ses, handlers); err != nil {
+		t.Error(err)
+	}
+	if expected := []Option{{"Test", "yes!"}}; !reflect.DeepEqual(ses.oack, expected) {
+		t.Errorf("expected %v; got %v", expected, ses.oack)
+	}
+
+	ses = session{req: &PacketRequest{OpRRQ, "foo", "octet", []Option{{"test", "ignore"}}}}
+	if err := svr.negotiate(&ses, handlers); err != nil || ses.oack != nil {
+		t.Error(ses.oack, err)
+	}
+
+	ses = session{req: &PacketRequest{OpRRQ, "foo", "octet", []Option{{"test", "refuse"}}}}
+	if err := svr.negotiate(&ses, handlers); err == nil || asPacketError(err, 0).Code != errOptionNegotiation {
+		t.Error(err)
+	}
+}
+
+func TestNegotiateBlockSize(t *testing.T) {
+	clientAddr, _ := resolveUDPAddr("127.0.0.1", 6969)
+	sock, err := createSessionSocket("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sock.Close()
+	pathSize, err := pathBlockSize(sock, clientAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	svr := Server{Conf: &Config{}}
+	svr.Conf.Init()
+	tests := []struct {
+		value string
+		ack   string
+		err   bool
+	}{
+		{"1428", "1428", false},
+		{"8", "8", false},
+		{"65464", strconv.Itoa(min(65464, pathSize)), false},
+		{"7", "", true},
+		{"65465", "", true},
+		{"big", "", true},
+	}
+	for _, test := range tests {
+		ses := session{sock: sock, clientAddr: clientAddr, blockSize: 512}
+		ack, ok, err := negotiateBlockSize(&svr, &ses, test.value)
+		if (err != nil) != test.err || ack != test.ack || ok != !test.err {
+			t.Errorf("blksize=%v: got %q, %v, %v", test.value, ack, ok, err)
+		}
+		if ok && strconv.Itoa(ses.blockSize) != ack {
+			t.Errorf("blksize=%v: session block size is %v", test.value, ses.blockSize)
+		}
+	}
+
+	svr.Conf.MaxBlockSize = 1024
+	ses := session{sock: sock, clientAddr: clientAddr, blockSize: 512}
+	if ack, _, _ := negotiateBlockSize(&svr, &ses, "8192"); ack != "1024" || ses.blockSize != 1024 {
+		t.Errorf("blksize clamped to %v: got %q", svr.Conf.MaxBlockSize, ack)
+	}
+}
+
+func TestNegotiateTransferSize(t *testing.T) {
+	svr := Server{Conf: &Config{}, Files: &FileManager{}}
+	svr.Conf.Init()
+	svr.Conf.MaxFileSize = 1000
+	svr.Files.Init()
+	if err := putThenGet(svr.Files, "f26", "abcdefghijklmnopqrstuvwxyz"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		op       uint16
+		filename string
+		value    string
+		ack      string
+		ok       bool
+		errCode  int // -1 if no error
+	}{
+		{OpRRQ, "f26", "0", "26", true, -1},
+		{OpRRQ, "missing", "0", "", false, -1},
+		{OpRRQ, "f26", "-1", "", false, errOptionNegotiation},
+		{OpWRQ, "new", "1000", "1000", true, -1},
+		{OpWRQ, "new", "1001", "", false, errDiskFull},
+		{OpWRQ, "new", "x", "", false, errOptionNegotiation},
+	}
+	clientAddr, _ := resolveUDPAddr("127.0.0.1", 6969)
+	for _, test := range tests {
+		ses := session{req: &PacketRequest{test.op, test.filename, "octet", nil}, clientAddr: clientAddr}
+		ack, ok, err := negotiateTransferSize(&svr, &ses, test.value)
+		if ack != test.ack || ok != test.ok {
+			t.Errorf("%v tsize=%v: got %q, %v", ses.req, test.value, ack, ok)
+		}
+		if test.errCode < 0 && err != nil ||
+			test.errCode >= 0 && (err == nil || asPacketError(err, 0).Code != uint16(test.errCode)) {
+			t.Errorf("%v tsize=%v: expected error code %v; got %v", ses.req, test.value, test.errCode, err)
+		}
+	}
+
+	// an upload is refused over what is left of the quotas of the client, and
+	// of the memory budget:
+	wrq := func(size string) error {
+		ses := session{req: &PacketRequest{OpWRQ, "new", "octet", nil}, clientAddr: clientAddr}
+		_, _, err := negotiateTransferSize(&svr, &ses, size)
+		return err
+	}
+	svr.Conf.ClientQuotaBytes, svr.Conf.ClientQuotaFiles = 500, 2
+	svr.quotas.reserveFile(svr.Conf, "127.0.0.1")
+	svr.quotas.reserveBytes(svr.Conf, "127.0.0.1", 100)
+	if err := wrq("400"); err != nil {
+		t.Error(err)
+	}
+	if err := wrq("401"); err == nil || asPacketError(err, 0).Code != errDiskFull {
+		t.Error(err)
+	}
+	svr.quotas.reserveFile(svr.Conf, "127.0.0.1")
+	if err := wrq("1"); err == nil || asPacketError(err, 0).Code != errDiskFull {
+		t.Error(err)
+	}
+	svr.Conf.ClientQuotaBytes, svr.Conf.ClientQuotaFiles = 0, 0
+
+	svr.Files.(*FileManager).Budget = 100
+	if err := wrq("74"); err != nil {
+		t.Error(err)
+	}
+	if err := wrq("75"); err == nil || asPacketError(err, 0).Code != errDiskFull {
+		t.Error(err)
+	}
+	svr.Files.(*FileManager).EvictLRU = true // f26 can be evicted
+	if err := wrq("100"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNegotiateTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		timeout time.Duration
+	}{
+		{"timeout", "1", time.Second},
+		{"timeout", "255", 255 * time.Second},
+		{"timeout", "0", 0},
+		{"timeout", "256", 0},
+		{"utimeout", "10000", 10 * time.Millisecond},
+		{"utimeout", "255000000", 255 * time.Second},
+		{"utimeout", "9999", 0},
+		{"utimeout", "1s", 0},
+	}
+	for _, test := range tests {
+		ses := session{req: &PacketRequest{OpRRQ, "foo", "octet", nil}}
+		ack, ok, err := optionHandlers[test.name](nil, &ses, test.value)
+		if test.timeout == 0 {
+			if err == nil || ok {
+				t.Errorf("%v=%v: expected an error; got %q", test.name, test.value, ack)
+			}
+		} else if err != nil || !ok || ack != test.value || ses.timeout != test.timeout {
+			t.Errorf("%v=%v: got %q, %v, %v, %v", test.name, test.value, ack, ok, err, ses.timeout)
+		}
+	}
+}
+
+func TestNegotiateWindowSize(t *testing.T) {
+	svr := Server{Conf: &Config{}}
+	svr.Conf.Init()
+	svr.Conf.MaxWindowSize = 16
+	tests := []struct {
+		value string
+		ack   string
+	}{
+		{"1", "1"},
+		{"8", "8"},
+		{"65535", "16"},
+		{"0", ""},
+		{"65536", ""},
+	}
+	for _, test := range tests {
+		ses := session{windowSize: 1}
+		ack, ok, err := negotiateWindowSize(&svr, &ses, test.value)
+		if ack != test.ack || ok != (test.ack != "") || (err != nil) != (test.ack == "") {
+			t.Errorf("windowsize=%v: got %q, %v, %v", test.value, ack, ok, err)
+		}
+		if ok && strconv.Itoa(ses.windowSize) != ack {
+			t.Errorf("windowsize=%v: session window size is %v", test.value, ses.windowSize)
+		}
+	}
+}
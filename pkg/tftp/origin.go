@@ -0,0 +1,384 @@
+package tftp
+
+import (
+	"container/list"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OriginBackend serves the files of Store, and fetches those it misses from an
+// HTTP(S) origin server, at URL followed by their names. A file is sent to the
+// client as it is downloaded, and cached in memory once downloaded, with the
+// validators of the origin: a cached file older than MaxAge is revalidated with
+// a conditional request before it is served again. If the origin cannot be
+// reached, or fails, the cached file is served as is.
+//
+// Uploads and deletes go to Store, and deletes also drop the cached files.
+//
+// The origin's responses map to the backend errors: 404 and 410 to
+// ErrNotFound, 401 and 403 to ErrAccess, and the other failures to
+// ErrUnavailable.
+type OriginBackend struct {
+	Store      Backend
+	URL        string        // base URL of the origin
+	CacheBytes int64         // bytes the cached files can take; 0 for no limit
+	MaxAge     time.Duration // a cached file is served without revalidation while younger; 0 to always revalidate
+	Client     *http.Client  `json:"-"` // nil for one with originTimeout
+
+	mutex  sync.Mutex
+	cached map[string]*originFile
+	lru    *list.List // of the cached files, the most recently used first
+	used   int64      // bytes taken by the cached files
+	clock  func() time.Time
+}
+
+// originFile is a cached file.
+type originFile struct {
+	name         string
+	content      []byte
+	etag         string
+	lastModified string
+	validated    time.Time
+	sha256, md5  string
+	element      *list.Element
+}
+
+// originReader streams a file as it is downloaded, and caches it at the end.
+type originReader struct {
+	backend   *OriginBackend
+	file      *originFile // without its content, until the download is over
+	body      io.ReadCloser
+	blockSize int
+	content   []byte // downloaded so far, nil if the file is not cached
+	length    int64  // announced by the origin, -1 if unknown
+	read      int64
+	eof       bool
+}
+
+// originTimeout is how long the origin has to answer, by default: the
+// downloads themselves are not limited in time.
+const originTimeout = 10 * time.Second
+
+func (o *OriginBackend) Init() (err error) {
+	if _, err = url.Parse(o.URL); err != nil {
+		return fmt.Errorf("origin: %w", err)
+	}
+	if o.Client == nil {
+		o.Client = &http.Client{Transport: &http.Transport{Proxy: http.ProxyFromEnvironment,
+			ResponseHeaderTimeout: originTimeout}}
+	}
+	o.mutex.Lock()
+	o.cached = make(map[string]*originFile)
+	o.lru = list.New()
+	o.used = 0
+	if o.clock == nil {
+		o.clock = time.Now
+	}
+	o.mutex.Unlock()
+	return o.Store.Init()
+}
+
+func (o *OriginBackend) DeInit() (err error) {
+	return o.Store.DeInit()
+}
+
+// Clear drops the cached files, and clears Store if it can be.
+func (o *OriginBackend) Clear() error {
+	o.mutex.Lock()
+	o.cached = make(map[string]*originFile)
+	o.lru.Init()
+	o.used = 0
+	o.mutex.Unlock()
+	if c, ok := o.Store.(clearer); ok {
+		return c.Clear()
+	}
+	return fmt.Errorf("the files stored are not cleared: %w", ErrAccess)
+}
+
+// location returns the URL of a file at the origin.
+func (o *OriginBackend) location(filename string) (string, error) {
+	if err := checkName(filename); err != nil {
+		return "", err
+	}
+	elements := strings.Split(filename, "/")
+	for i, element := range elements {
+		elements[i] = url.PathEscape(element)
+	}
+	return strings.TrimSuffix(o.URL, "/") + "/" + strings.Join(elements, "/"), nil
+}
+
+// originError returns the backend error of a failed response of the origin.
+func originError(filename string, resp *http.Response) error {
+	switch resp.StatusCode {
+	case http.StatusNotFound, http.StatusGone:
+		return fmt.Errorf("%v %w", filename, ErrNotFound)
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return fmt.Errorf("%v: origin answered %v: %w", filename, resp.Status, ErrAccess)
+	}
+	return fmt.Errorf("%v: origin answered %v: %w", filename, resp.Status, ErrUnavailable)
+}
+
+// request sends a request for a file to the origin: a conditional one if the
+// file is cached. It returns a response to read and close, or nil if the
+// cached file is still valid.
+func (o *OriginBackend) request(method, filename string, cached *originFile) (*http.Response, error) {
+	location, err := o.location(filename)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, location, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", filename, err)
+	}
+	if cached != nil {
+		if cached.etag != "" {
+			req.Header.Set("If-None-Match", cached.etag)
+		}
+		if cached.lastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.lastModified)
+		}
+	}
+	resp, err := o.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v: %w", filename, err, ErrUnavailable)
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotModified && cached != nil:
+		resp.Body.Close()
+		return nil, nil
+	case resp.StatusCode != http.StatusOK:
+		resp.Body.Close()
+		return nil, originError(filename, resp)
+	}
+	return resp, nil
+}
+
+// cachedFile returns a cached file, as the most recently used one.
+func (o *OriginBackend) cachedFile(filename string) *originFile {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	file, ok := o.cached[filename]
+	if !ok {
+		return nil
+	}
+	o.lru.MoveToFront(file.element)
+	return file
+}
+
+// cache stores a downloaded file, replacing the cached one, and evicts the
+// least recently used ones to stay within CacheBytes.
+func (o *OriginBackend) cache(file *originFile) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if old, ok := o.cached[file.name]; ok {
+		o.uncache(old)
+	}
+	size := int64(len(file.content))
+	for e := o.lru.Back(); e != nil && o.CacheBytes > 0 && o.used+size > o.CacheBytes; e = o.lru.Back() {
+		o.uncache(e.Value.(*originFile))
+	}
+	o.cached[file.name] = file
+	file.element = o.lru.PushFront(file)
+	o.used += size
+}
+
+// uncache drops a cached file. The caller holds the mutex.
+func (o *OriginBackend) uncache(file *originFile) {
+	delete(o.cached, file.name)
+	o.lru.Remove(file.element)
+	o.used -= int64(len(file.content))
+}
+
+// forget drops a cached file, unless it was replaced in the meantime.
+func (o *OriginBackend) forget(file *originFile) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.cached[file.name] == file {
+		o.uncache(file)
+	}
+}
+
+// validated notes that a cached file is still that of the origin.
+func (o *OriginBackend) validated(file *originFile) {
+	o.mutex.Lock()
+	file.validated = o.clock()
+	o.mutex.Unlock()
+}
+
+// fresh tells if a cached file can be served without revalidation.
+func (o *OriginBackend) fresh(file *originFile) bool {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return o.clock().Sub(file.validated) < o.MaxAge
+}
+
+// Get reads a file of Store, or else of the origin.
+func (o *OriginBackend) Get(filename string, blockSize int) (FileReader, error) {
+	if file, err := o.Store.Get(filename, blockSize); !errors.Is(err, ErrNotFound) {
+		return file, err
+	}
+	cached := o.cachedFile(filename)
+	if cached != nil && o.fresh(cached) {
+		return newFileReader(cached.content, blockSize), nil
+	}
+	resp, err := o.request(http.MethodGet, filename, cached)
+	switch {
+	case err == nil && resp == nil:
+		o.validated(cached)
+		return newFileReader(cached.content, blockSize), nil
+	case errors.Is(err, ErrUnavailable) && cached != nil:
+		log.Println(err, "- serving the cached file")
+		return newFileReader(cached.content, blockSize), nil
+	case err != nil:
+		if errors.Is(err, ErrNotFound) && cached != nil {
+			o.forget(cached) // gone from the origin too
+		}
+		return nil, err
+	}
+
+	log.Printf("Fetching %v from %v\n", filename, resp.Request.URL)
+	r := &originReader{backend: o, body: resp.Body, blockSize: blockSize, length: resp.ContentLength,
+		file: &originFile{name: filename, etag: resp.Header.Get("ETag"),
+			lastModified: resp.Header.Get("Last-Modified"), validated: o.clock()}}
+	// A file that does not fit in the cache is streamed without being kept:
+	if o.CacheBytes == 0 || resp.ContentLength <= o.CacheBytes {
+		r.content = []byte{}
+	}
+	return r, nil
+}
+
+func (r *originReader) Read() ([]byte, error) {
+	if r.eof {
+		return nil, nil
+	}
+	buf, err := readBlock(r.body, r.blockSize)
+	r.read += int64(len(buf))
+	if r.eof = len(buf) < r.blockSize; r.eof && r.length >= 0 && r.read != r.length {
+		err = fmt.Errorf("%v bytes of %v", r.read, r.length)
+	}
+	if err != nil {
+		r.content = nil // a partial download is never cached
+		return nil, fmt.Errorf("fetching %v: %v: %w", r.file.name, err, ErrUnavailable)
+	}
+	if r.content != nil {
+		if o := r.backend; o.CacheBytes > 0 && int64(len(r.content)+len(buf)) > o.CacheBytes {
+			r.content = nil
+		} else {
+			r.content = append(r.content, buf...)
+		}
+	}
+	if r.eof && r.content != nil {
+		r.file.content = r.content
+		sha, md := sha256.Sum256(r.content), md5.Sum(r.content)
+		r.file.sha256, r.file.md5 = hex.EncodeToString(sha[:]), hex.EncodeToString(md[:])
+		r.backend.cache(r.file)
+		r.content = nil
+	}
+	return buf, nil
+}
+
+// Close ends the download, which is not cached unless it was complete.
+func (r *originReader) Close() error {
+	return r.body.Close()
+}
+
+// Stat describes a file of Store, or else a cached file, or else asks the
+// origin for its size.
+func (o *OriginBackend) Stat(filename string) (FileInfo, error) {
+	if info, err := o.Store.Stat(filename); !errors.Is(err, ErrNotFound) {
+		return info, err
+	}
+	if cached := o.cachedFile(filename); cached != nil {
+		return FileInfo{filename, int64(len(cached.content))}, nil
+	}
+	resp, err := o.request(http.MethodHead, filename, nil)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	resp.Body.Close()
+	if resp.ContentLength < 0 {
+		return FileInfo{}, fmt.Errorf("%v: the origin does not tell its size: %w", filename, ErrUnavailable)
+	}
+	return FileInfo{filename, resp.ContentLength}, nil
+}
+
+// List describes the files of Store, and the cached files it does not have.
+func (o *OriginBackend) List() ([]FileInfo, error) {
+	infos, err := o.Store.List()
+	if err != nil {
+		return nil, err
+	}
+	stored := make(map[string]bool, len(infos))
+	for _, info := range infos {
+		stored[info.Name] = true
+	}
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	for name, file := range o.cached {
+		if !stored[name] {
+			infos = append(infos, FileInfo{name, int64(len(file.content))})
+		}
+	}
+	return infos, nil
+}
+
+func (o *OriginBackend) Browse(prefix, after string, limit int) (Listing, error) {
+	infos, err := o.List()
+	if err != nil {
+		return Listing{}, err
+	}
+	l := listFiles(infos, prefix, after, limit)
+	if l.Dir != "" && l.Files == 0 {
+		return Listing{}, fmt.Errorf("directory %v %w", l.Dir, ErrNotFound)
+	}
+	return l, nil
+}
+
+func (o *OriginBackend) Put(filename string, options PutOptions) (FileWriter, error) {
+	return o.Store.Put(filename, options)
+}
+
+// Delete removes a file from Store, and from the cache.
+func (o *OriginBackend) Delete(filename string) error {
+	err := o.Store.Delete(filename)
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if file, ok := o.cached[filename]; ok {
+		o.uncache(file)
+		return nil
+	}
+	return err
+}
+
+// countDownload counts the downloads of the files of Store, if it does.
+func (o *OriginBackend) countDownload(filename string) {
+	if counter, ok := o.Store.(downloadCounter); ok {
+		counter.countDownload(filename)
+	}
+}
+
+// Metadata describes a file of Store, or else a cached file: its modification
+// time is the origin's Last-Modified.
+func (o *OriginBackend) Metadata(filename string) (Metadata, error) {
+	if meta, err := o.Store.Metadata(filename); !errors.Is(err, ErrNotFound) {
+		return meta, err
+	}
+	cached := o.cachedFile(filename)
+	if cached == nil {
+		return Metadata{}, fmt.Errorf("%v %w", filename, ErrNotFound)
+	}
+	meta := Metadata{FileInfo: FileInfo{filename, int64(len(cached.content))},
+		SHA256: cached.sha256, MD5: cached.md5}
+	meta.Modified, _ = http.ParseTime(cached.lastModified)
+	return meta, nil
+}
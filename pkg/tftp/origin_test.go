@@ -0,0 +1,200 @@
+package tftp
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testOrigin serves files with their validators, and counts the requests.
+type testOrigin struct {
+	mutex       sync.Mutex
+	files       map[string]string
+	requests    int
+	notModified int
+	status      int           // of every response, if not 0
+	unblock     chan struct{} // the second half of /slow waits for it
+}
+
+func (origin *testOrigin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	origin.mutex.Lock()
+	origin.requests++
+	content, ok := origin.files[r.URL.Path]
+	etag := `"` + content + `"`
+	if r.Header.Get("If-None-Match") == etag {
+		origin.notModified++
+	}
+	status := origin.status
+	origin.mutex.Unlock()
+	switch {
+	case status != 0:
+		http.Error(w, http.StatusText(status), status)
+	case r.URL.Path == "/private":
+		http.Error(w, "forbidden", http.StatusForbidden)
+	case r.URL.Path == "/broken":
+		http.Error(w, "broken", http.StatusInternalServerError)
+	case r.URL.Path == "/truncated":
+		w.Header().Set("Content-Length", "2000")
+		w.Write([]byte(strings.Repeat("a", 700)))
+	case r.URL.Path == "/slow":
+		w.Write([]byte(strings.Repeat("a", 1000)))
+		w.(http.Flusher).Flush()
+		<-origin.unblock
+		w.Write([]byte(strings.Repeat("b", 1000)))
+	case !ok:
+		http.NotFound(w, r)
+	default:
+		w.Header().Set("ETag", etag)
+		http.ServeContent(w, r, r.URL.Path, time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+			strings.NewReader(content))
+	}
+}
+
+func (origin *testOrigin) counts() (int, int) {
+	origin.mutex.Lock()
+	defer origin.mutex.Unlock()
+	return origin.requests, origin.notModified
+}
+
+func (origin *testOrigin) setStatus(status int) {
+	origin.mutex.Lock()
+	origin.status = status
+	origin.mutex.Unlock()
+}
+
+func TestOriginBackend(t *testing.T) {
+	origin := &testOrigin{files: map[string]string{"/boot/vmlinuz": "kernel",
+		"/big": strings.Repeat("0123456789", 10)}, unblock: make(chan struct{})}
+	server := httptest.NewServer(origin)
+	defer server.Close()
+	clock := &fakeClock{time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	o := &OriginBackend{Store: &FileManager{}, URL: server.URL + "/", CacheBytes: 50, clock: clock.Now}
+	if err := o.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer o.DeInit()
+	if err := putThenGet(o, "local", "local"); err != nil {
+		t.Error(err)
+	}
+	// the status of the admin interface describes the backend:
+	if _, err := json.Marshal(&Server{Files: o}); err != nil {
+		t.Error(err)
+	}
+
+	// a file is fetched, then revalidated:
+	for i := 0; i < 2; i++ {
+		if err := getContent(o, "boot/vmlinuz", "kernel"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if requests, notModified := origin.counts(); requests != 2 || notModified != 1 {
+		t.Error(requests, notModified)
+	}
+	meta, err := o.Metadata("boot/vmlinuz")
+	if err != nil || meta.Size != 6 || meta.MD5 != "50484c19f1afdaf3841a0d821ed393d2" ||
+		!meta.Modified.Equal(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)) {
+		t.Error(meta, err)
+	}
+	origin.mutex.Lock()
+	origin.files["/boot/vmlinuz"] = "new kernel"
+	origin.mutex.Unlock()
+	if err := getContent(o, "boot/vmlinuz", "new kernel"); err != nil {
+		t.Error(err)
+	}
+	// ... or not, while it is fresh:
+	o.MaxAge = time.Minute
+	if err := getContent(o, "boot/vmlinuz", "new kernel"); err != nil {
+		t.Error(err)
+	}
+	if requests, _ := origin.counts(); requests != 3 {
+		t.Error(requests)
+	}
+	clock.now = clock.now.Add(time.Minute)
+	if err := getContent(o, "boot/vmlinuz", "new kernel"); err != nil {
+		t.Error(err)
+	}
+	if requests, notModified := origin.counts(); requests != 4 || notModified != 2 {
+		t.Error(requests, notModified)
+	}
+	o.MaxAge = 0
+
+	// files over the size of the cache are not kept:
+	if info, err := o.Stat("big"); info.Size != 100 || err != nil {
+		t.Error(info, err)
+	}
+	if err := getContent(o, "big", strings.Repeat("0123456789", 10)); err != nil {
+		t.Error(err)
+	}
+	if infos, _ := o.List(); len(infos) != 2 {
+		t.Error(infos)
+	}
+
+	// the failures of the origin:
+	for name, sentinel := range map[string]error{"missing": ErrNotFound, "private": ErrAccess,
+		"broken": ErrUnavailable} {
+		if _, err := o.Get(name, blockSize); !errors.Is(err, sentinel) {
+			t.Errorf("%v: %v", name, err)
+		}
+	}
+	if code := fileErrorCode(ErrUnavailable, errFileNotFound); code != errNotDefined {
+		t.Error(code)
+	}
+	// a download cut short is an error, and is not cached:
+	if err := getContent(o, "truncated", strings.Repeat("a", 700)); !errors.Is(err, ErrUnavailable) {
+		t.Error(err)
+	}
+	if infos, _ := o.List(); len(infos) != 2 {
+		t.Error(infos)
+	}
+	// the cached file is served if the origin fails, and dropped once it is
+	// gone from the origin:
+	origin.setStatus(http.StatusServiceUnavailable)
+	if err := getContent(o, "boot/vmlinuz", "new kernel"); err != nil {
+		t.Error(err)
+	}
+	origin.setStatus(http.StatusNotFound)
+	if _, err := o.Get("boot/vmlinuz", blockSize); !errors.Is(err, ErrNotFound) {
+		t.Error(err)
+	}
+	if infos, _ := o.List(); len(infos) != 1 {
+		t.Error(infos)
+	}
+}
+
+func TestOriginBackendStreaming(t *testing.T) {
+	origin := &testOrigin{unblock: make(chan struct{})}
+	server := httptest.NewServer(origin)
+	defer server.Close()
+	o := &OriginBackend{Store: &FileManager{}, URL: server.URL}
+	if err := o.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer o.DeInit()
+
+	// the first block is read before the origin sends the rest:
+	r, err := o.Get("slow", 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if buf, err := r.Read(); len(buf) != 512 || err != nil {
+		t.Fatal(len(buf), err)
+	}
+	close(origin.unblock)
+	var read bytes.Buffer
+	for buf, _ := r.Read(); buf != nil; buf, _ = r.Read() {
+		read.Write(buf)
+	}
+	if read.Len() != 2000-512 {
+		t.Error(read.Len())
+	}
+	if info, err := o.Stat("slow"); info.Size != 2000 || err != nil {
+		t.Error("not cached:", info, err)
+	}
+}
@@ -0,0 +1,329 @@
+package tftp
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// OverlayBackend stacks a FileManager over a read-only backend, such as a
+// DiskBackend or an ArchiveBackend: the files of Upper hide those of Lower
+// with the same names, uploads are stored in Upper, and deletes remove the
+// files of Upper and hide those of Lower with whiteouts. Lower is never
+// written to, and Clear brings it back as it is.
+//
+// An upload clears the whiteout of its name: if the upload expires, the file
+// of Lower is back. The whiteouts are kept in memory only: they do not survive
+// a restart, even if Upper does with a snapshot.
+type OverlayBackend struct {
+	Lower Backend
+	Upper *FileManager
+
+	mutex     sync.RWMutex    // protects whiteouts, and serializes the commits
+	whiteouts map[string]bool // files of Lower deleted
+}
+
+// overlayWriter stages an upload in Upper, and applies its overwrite policy to
+// the files of both layers when it is committed.
+type overlayWriter struct {
+	overlay   *OverlayBackend
+	upper     *FileIterator
+	filename  string
+	overwrite Overwrite
+}
+
+func (o *OverlayBackend) Init() (err error) {
+	o.mutex.Lock()
+	o.whiteouts = make(map[string]bool)
+	o.mutex.Unlock()
+	if err = o.Lower.Init(); err != nil {
+		return
+	}
+	return o.Upper.Init()
+}
+
+func (o *OverlayBackend) DeInit() (err error) {
+	err = o.Upper.DeInit()
+	if e := o.Lower.DeInit(); err == nil {
+		err = e
+	}
+	return
+}
+
+// Clear deletes the files of Upper, and the whiteouts: the files are those of
+// Lower again.
+func (o *OverlayBackend) Clear() error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.whiteouts = make(map[string]bool)
+	files, err := o.Upper.List()
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		o.Upper.Delete(file.Name)
+	}
+	return nil
+}
+
+// lower returns a file of Lower, unless it was deleted. The caller holds the
+// mutex.
+func (o *OverlayBackend) lower(filename string) (FileInfo, error) {
+	if o.whiteouts[filename] {
+		return FileInfo{}, fmt.Errorf("%v %w", filename, ErrNotFound)
+	}
+	return o.Lower.Stat(filename)
+}
+
+// stat describes a file of either layer. The caller holds the mutex.
+func (o *OverlayBackend) stat(filename string) (FileInfo, error) {
+	if info, err := o.Upper.Stat(filename); !errors.Is(err, ErrNotFound) {
+		return info, err
+	}
+	return o.lower(filename)
+}
+
+func (o *OverlayBackend) Stat(filename string) (FileInfo, error) {
+	o.mutex.RLock()
+	defer o.mutex.RUnlock()
+	return o.stat(filename)
+}
+
+// list describes the files of both layers. The caller holds the mutex.
+func (o *OverlayBackend) list() ([]FileInfo, error) {
+	infos, err := o.Upper.List()
+	if err != nil {
+		return nil, err
+	}
+	upper := make(map[string]bool, len(infos))
+	for _, info := range infos {
+		upper[info.Name] = true
+	}
+	lower, err := o.Lower.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range lower {
+		if !upper[info.Name] && !o.whiteouts[info.Name] {
+			infos = append(infos, info)
+		}
+	}
+	return infos, nil
+}
+
+// List describes the files of both layers, in no particular order.
+func (o *OverlayBackend) List() ([]FileInfo, error) {
+	o.mutex.RLock()
+	defer o.mutex.RUnlock()
+	return o.list()
+}
+
+func (o *OverlayBackend) Browse(prefix, after string, limit int) (Listing, error) {
+	o.mutex.RLock()
+	infos, err := o.list()
+	o.mutex.RUnlock()
+	if err != nil {
+		return Listing{}, err
+	}
+	l := listFiles(infos, prefix, after, limit)
+	if l.Dir != "" && l.Files == 0 {
+		return Listing{}, fmt.Errorf("directory %v %w", l.Dir, ErrNotFound)
+	}
+	return l, nil
+}
+
+func (o *OverlayBackend) Get(filename string, blockSize int) (FileReader, error) {
+	o.mutex.RLock()
+	defer o.mutex.RUnlock()
+	if file, err := o.Upper.Get(filename, blockSize); !errors.Is(err, ErrNotFound) {
+		return file, err
+	}
+	if o.whiteouts[filename] {
+		return nil, fmt.Errorf("%v %w", filename, ErrNotFound)
+	}
+	return o.Lower.Get(filename, blockSize)
+}
+
+func (o *OverlayBackend) Metadata(filename string) (Metadata, error) {
+	o.mutex.RLock()
+	defer o.mutex.RUnlock()
+	if meta, err := o.Upper.Metadata(filename); !errors.Is(err, ErrNotFound) {
+		return meta, err
+	}
+	if o.whiteouts[filename] {
+		return Metadata{}, fmt.Errorf("%v %w", filename, ErrNotFound)
+	}
+	return o.Lower.Metadata(filename)
+}
+
+// countDownload counts the downloads of the files of Upper only.
+func (o *OverlayBackend) countDownload(filename string) {
+	o.Upper.countDownload(filename)
+}
+
+// Delete removes a file from Upper, and hides it in Lower.
+func (o *OverlayBackend) Delete(filename string) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return o.delete(filename)
+}
+
+// delete removes a file from both layers. The caller holds the mutex.
+func (o *OverlayBackend) delete(filename string) error {
+	err := o.Upper.Delete(filename)
+	if o.hide(filename) {
+		return nil
+	}
+	return err
+}
+
+// hide whites out a file of Lower, and tells if there was one. The caller
+// holds the mutex.
+func (o *OverlayBackend) hide(filename string) bool {
+	if _, err := o.lower(filename); err != nil {
+		return false
+	}
+	o.whiteouts[filename] = true
+	return true
+}
+
+// conflict tells why a file cannot be stored as filename in either layer: it
+// is a directory, or one of its directories is a file. The caller holds the
+// mutex.
+func (o *OverlayBackend) conflict(filename string) error {
+	for dir, _ := splitName(filename); dir != ""; dir, _ = splitName(dir) {
+		if _, err := o.stat(dir); err == nil {
+			return fmt.Errorf("%v is a file: %w", dir, ErrAccess)
+		}
+	}
+	if _, err := o.Upper.Browse(filename+"/", "", 1); err == nil {
+		return fmt.Errorf("%v is a directory: %w", filename, ErrExists)
+	}
+	// only the directory is browsed in Lower, not all of its files:
+	lower, err := o.Lower.Browse(filename+"/", "", 1)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	deleted := 0
+	for name := range o.whiteouts {
+		if strings.HasPrefix(name, filename+"/") {
+			deleted++
+		}
+	}
+	if lower.Files > deleted {
+		return fmt.Errorf("%v is a directory: %w", filename, ErrExists)
+	}
+	return nil
+}
+
+// Put stages an upload in Upper. The files of Lower count as existing files
+// for its overwrite policy.
+func (o *OverlayBackend) Put(filename string, options PutOptions) (FileWriter, error) {
+	if err := checkName(filename); err != nil {
+		return nil, err
+	}
+	o.mutex.RLock()
+	defer o.mutex.RUnlock()
+	if err := o.conflict(filename); err != nil {
+		return nil, err
+	}
+	if _, err := o.stat(filename); err == nil && options.Overwrite.Policy == OverwriteReject {
+		return nil, fmt.Errorf("%v %w", filename, ErrExists)
+	}
+	// Upper stores the upload as the name the overlay's policy gives it:
+	upper, err := o.Upper.Put(filename, PutOptions{Overwrite{Policy: OverwriteReplace}, options.Client})
+	if err != nil {
+		return nil, err
+	}
+	return &overlayWriter{overlay: o, upper: upper.(*FileIterator), filename: filename,
+		overwrite: options.Overwrite}, nil
+}
+
+// copyUp copies a file of Lower to Upper. The caller holds the mutex.
+func (o *OverlayBackend) copyUp(from, to string) error {
+	reader, err := o.Lower.Get(from, 32*1024)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	writer, err := o.Upper.Put(to, PutOptions{Overwrite: Overwrite{Policy: OverwriteReplace}})
+	if err != nil {
+		return err
+	}
+	for {
+		buf, err := reader.Read()
+		if err == nil && buf != nil {
+			err = writer.Write(buf)
+		}
+		if err != nil {
+			writer.Abort()
+			return err
+		}
+		if buf == nil {
+			return writer.Commit()
+		}
+	}
+}
+
+// move renames a file of either layer, or deletes it if to is "", for the
+// overwrite policies. The files of Lower are copied to Upper. The caller holds
+// the mutex.
+func (o *OverlayBackend) move(from, to string) (err error) {
+	switch {
+	case to == "":
+		return o.delete(from)
+	case o.Upper.Exists(from):
+		err = o.Upper.rename(from, to)
+	default:
+		err = o.copyUp(from, to)
+	}
+	if err != nil {
+		return err
+	}
+	o.hide(from)
+	delete(o.whiteouts, to)
+	return nil
+}
+
+func (w *overlayWriter) Write(buf []byte) error {
+	return w.upper.Write(buf)
+}
+
+// Commit stores the upload in Upper, as its overwrite policy tells if the file
+// exists in either layer.
+func (w *overlayWriter) Commit() error {
+	o := w.overlay
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	exists := func(name string) bool {
+		_, err := o.stat(name)
+		return err == nil
+	}
+	if err := o.conflict(w.filename); err != nil {
+		return err
+	}
+	name, err := w.overwrite.apply(w.filename, exists, o.move)
+	if err != nil {
+		return err
+	}
+	if err = o.conflict(name); err != nil {
+		return err
+	}
+	w.upper.filename = name
+	if err = w.upper.Commit(); err != nil {
+		return err
+	}
+	delete(o.whiteouts, name)
+	return nil
+}
+
+func (w *overlayWriter) Abort() error {
+	return w.upper.Abort()
+}
+
+func (w *overlayWriter) Name() string {
+	return w.upper.Name()
+}
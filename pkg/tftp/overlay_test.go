@@ -0,0 +1,124 @@
+package tftp
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newOverlay returns an overlay of the files of a directory, which it creates.
+func newOverlay(t *testing.T, files map[string]string) (*OverlayBackend, string) {
+	root := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	o := &OverlayBackend{Lower: &DiskBackend{Root: root}, Upper: &FileManager{}}
+	if err := o.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return o, root
+}
+
+func TestOverlay(t *testing.T) {
+	o, root := newOverlay(t, map[string]string{"golden": "golden", "boot/vmlinuz": "kernel"})
+	defer o.DeInit()
+	replace := Overwrite{Policy: OverwriteReplace}
+
+	if err := getContent(o, "golden", "golden"); err != nil {
+		t.Error(err)
+	}
+	if _, err := upload(o, "golden", "new", Overwrite{}); !errors.Is(err, ErrExists) {
+		t.Error(err)
+	}
+	if _, err := upload(o, "boot/vmlinuz", "test kernel", replace); err != nil {
+		t.Fatal(err)
+	}
+	if err := getContent(o, "boot/vmlinuz", "test kernel"); err != nil {
+		t.Error(err)
+	}
+	if err := o.Delete("golden"); err != nil {
+		t.Error(err)
+	}
+	if _, err := o.Get("golden", blockSize); !errors.Is(err, ErrNotFound) {
+		t.Error(err)
+	}
+	if err := o.Delete("golden"); !errors.Is(err, ErrNotFound) {
+		t.Error(err)
+	}
+	if infos, err := o.List(); len(infos) != 1 || infos[0] != (FileInfo{"boot/vmlinuz", 11}) || err != nil {
+		t.Error(infos, err)
+	}
+	if l, err := o.Browse("", "", 0); err != nil || l.Files != 1 || l.Bytes != 11 {
+		t.Error(l, err)
+	}
+
+	// the file names of both layers conflict:
+	if _, err := upload(o, "boot", "x", replace); !errors.Is(err, ErrExists) {
+		t.Error(err)
+	}
+	if _, err := upload(o, "boot/vmlinuz/x", "x", replace); !errors.Is(err, ErrAccess) {
+		t.Error(err)
+	}
+	if _, err := upload(o, "golden/x", "x", replace); err != nil {
+		t.Error("a deleted file is no directory:", err)
+	}
+	o.Delete("golden/x")
+
+	// a file of the lower layer is copied up as a previous version:
+	if err := o.Clear(); err != nil {
+		t.Error(err)
+	}
+	if _, err := upload(o, "golden", "new", Overwrite{Policy: OverwriteVersions, Versions: 1}); err != nil {
+		t.Error(err)
+	}
+	for name, content := range map[string]string{"golden": "new", "golden.~1~": "golden",
+		"boot/vmlinuz": "kernel"} {
+		if err := getContent(o, name, content); err != nil {
+			t.Error(name, err)
+		}
+	}
+
+	// the lower layer is left as it is, and is back as it is once cleared:
+	o.Clear()
+	for name, content := range map[string]string{"golden": "golden", "boot/vmlinuz": "kernel"} {
+		if err := getContent(o, name, content); err != nil {
+			t.Error(name, err)
+		}
+		if b, err := os.ReadFile(filepath.Join(root, name)); string(b) != content || err != nil {
+			t.Error(name, string(b), err)
+		}
+	}
+	if infos, _ := o.List(); len(infos) != 2 {
+		t.Error(infos)
+	}
+}
+
+func TestOverlayDirectory(t *testing.T) {
+	o, _ := newOverlay(t, map[string]string{"dir/a": "a", "dir/sub/b": "b"})
+	defer o.DeInit()
+	replace := Overwrite{Policy: OverwriteReplace}
+
+	// a directory of Lower is one until all of its files are deleted:
+	o.Delete("dir/a")
+	if _, err := upload(o, "dir", "x", replace); !errors.Is(err, ErrExists) {
+		t.Error(err)
+	}
+	o.Delete("dir/sub/b")
+	if _, err := upload(o, "dir", "x", replace); err != nil {
+		t.Error(err)
+	}
+	if err := getContent(o, "dir", "x"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOverwriteOverlay(t *testing.T) {
+	o, _ := newOverlay(t, nil)
+	defer o.DeInit()
+	testOverwrite(t, o)
+}
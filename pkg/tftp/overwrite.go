@@ -0,0 +1,131 @@
+package tftp
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// OverwritePolicy tells what an upload does when a file of the same name
+// exists.
+type OverwritePolicy int
+
+const (
+	OverwriteReject   OverwritePolicy = iota // the upload is refused
+	OverwriteReplace                         // the upload replaces the file
+	OverwriteVersions                        // the file is kept as a previous version, name.~1~
+	OverwriteRename                          // the upload is stored as name.1, name.2...
+)
+
+var overwritePolicyNames = []string{"reject", "overwrite", "versions", "rename"}
+
+func (p OverwritePolicy) String() string {
+	if int(p) < len(overwritePolicyNames) {
+		return overwritePolicyNames[p]
+	}
+	return fmt.Sprintf("OverwritePolicy(%d)", int(p))
+}
+
+func (p OverwritePolicy) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+// Overwrite is the overwrite policy of an upload.
+type Overwrite struct {
+	Policy   OverwritePolicy
+	Versions int // number of previous versions kept by OverwriteVersions
+}
+
+// OverwriteRule applies an overwrite policy to the files whose names start
+// with Prefix.
+type OverwriteRule struct {
+	Prefix string
+	Overwrite
+}
+
+// versionName is the name of the n'th previous version of a file.
+func versionName(filename string, n int) string {
+	return fmt.Sprintf("%v.~%v~", filename, n)
+}
+
+// renamedName is the n'th name an upload is stored as, when it is renamed.
+func renamedName(filename string, n int) string {
+	return fmt.Sprintf("%v.%v", filename, n)
+}
+
+// apply prepares the storage of an upload as filename, in a backend where
+// exists tells if a file exists, and move renames a file, or deletes it if to
+// is "". It returns the name to store the upload as.
+func (o Overwrite) apply(filename string, exists func(name string) bool,
+	move func(from, to string) error) (string, error) {
+	if !exists(filename) {
+		return filename, nil
+	}
+	switch o.Policy {
+	case OverwriteReplace:
+		return filename, nil
+	case OverwriteVersions:
+		if o.Versions <= 0 {
+			return filename, nil
+		}
+		if exists(versionName(filename, o.Versions)) {
+			if err := move(versionName(filename, o.Versions), ""); err != nil {
+				return "", err
+			}
+		}
+		for n := o.Versions - 1; n > 0; n-- {
+			if exists(versionName(filename, n)) {
+				if err := move(versionName(filename, n), versionName(filename, n+1)); err != nil {
+					return "", err
+				}
+			}
+		}
+		if err := move(filename, versionName(filename, 1)); err != nil {
+			return "", err
+		}
+		return filename, nil
+	case OverwriteRename:
+		name := filename
+		for n := 1; exists(name); n++ {
+			name = renamedName(filename, n)
+		}
+		return name, nil
+	default:
+		return "", fmt.Errorf("%v %w", filename, ErrExists)
+	}
+}
+
+// UploadRecord describes an upload in the admin status.
+type UploadRecord struct {
+	Time     time.Time
+	Client   string
+	Filename string
+	Policy   OverwritePolicy
+	StoredAs string `json:",omitempty"` // the name the file was stored as
+	Error    string `json:",omitempty"` // why it was not
+}
+
+// maxUploadRecords is the number of uploads the admin status shows.
+const maxUploadRecords = 100
+
+// uploadHistory keeps the last uploads, for the admin status.
+type uploadHistory struct {
+	mutex   sync.Mutex
+	records []UploadRecord
+}
+
+func (h *uploadHistory) add(record UploadRecord) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.records = append(h.records, record)
+	if len(h.records) > maxUploadRecords {
+		h.records = h.records[len(h.records)-maxUploadRecords:]
+	}
+}
+
+func (h *uploadHistory) MarshalJSON() ([]byte, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return json.Marshal(h.records)
+}
@@ -0,0 +1,89 @@
+package tftp
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// upload stores content as filename, and returns the name it was stored as.
+func upload(b Backend, filename string, content string, overwrite Overwrite) (string, error) {
+	w, err := b.Put(filename, PutOptions{Overwrite: overwrite})
+	if err != nil {
+		return "", err
+	}
+	if err = w.Write([]byte(content)); err != nil {
+		w.Abort()
+		return "", err
+	}
+	if err = w.Commit(); err != nil {
+		return "", err
+	}
+	return w.Name(), nil
+}
+
+// testOverwrite uploads 3 versions of a file with each policy, and checks what
+// the backend stores.
+func testOverwrite(t *testing.T, b Backend) {
+	tests := []struct {
+		overwrite Overwrite
+		storedAs  []string
+		files     map[string]int64 // name: size, of the version that ends up there
+		err       bool             // the second and third uploads are refused
+	}{
+		{Overwrite{Policy: OverwriteReject}, []string{"a"}, map[string]int64{"a": 1}, true},
+		{Overwrite{Policy: OverwriteReplace}, []string{"a", "a", "a"}, map[string]int64{"a": 3}, false},
+		{Overwrite{Policy: OverwriteVersions, Versions: 1}, []string{"a", "a", "a"},
+			map[string]int64{"a": 3, "a.~1~": 2}, false},
+		{Overwrite{Policy: OverwriteVersions, Versions: 5}, []string{"a", "a", "a"},
+			map[string]int64{"a": 3, "a.~1~": 2, "a.~2~": 1}, false},
+		{Overwrite{Policy: OverwriteRename}, []string{"a", "a.1", "a.2"},
+			map[string]int64{"a": 1, "a.1": 2, "a.2": 3}, false},
+	}
+	for _, test := range tests {
+		dir := fmt.Sprintf("%v%v/", test.overwrite.Policy, test.overwrite.Versions)
+		for i := 1; i <= 3; i++ {
+			name, err := upload(b, dir+"a", "123"[:i], test.overwrite)
+			if i > 1 && test.err {
+				if !errors.Is(err, ErrExists) {
+					t.Errorf("%v: expected a refusal; got %v", test.overwrite.Policy, err)
+				}
+				continue
+			}
+			if err != nil || name != dir+test.storedAs[i-1] {
+				t.Errorf("%v: upload #%v stored as %q: %v", test.overwrite.Policy, i, name, err)
+			}
+		}
+		for name, size := range test.files {
+			if info, err := b.Stat(dir + name); info.Size != size || err != nil {
+				t.Errorf("%v: %v is %v", test.overwrite.Policy, name, info)
+			}
+		}
+		// no other file:
+		infos, _ := b.List()
+		count := 0
+		for _, info := range infos {
+			if strings.HasPrefix(info.Name, dir) {
+				count++
+			}
+		}
+		if count != len(test.files) {
+			t.Errorf("%v: %v files in %v", test.overwrite.Policy, count, infos)
+		}
+	}
+}
+
+func TestOverwriteFileManager(t *testing.T) {
+	fm := FileManager{}
+	fm.Init()
+	testOverwrite(t, &fm)
+}
+
+func TestOverwriteDiskBackend(t *testing.T) {
+	d := DiskBackend{Root: t.TempDir(), CreateDirectories: true}
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	testOverwrite(t, &d)
+}
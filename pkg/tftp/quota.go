@@ -0,0 +1,145 @@
+package tftp
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+// ClientUsage is what a client stores: the files it uploaded, until they are
+// deleted, replaced, expired or evicted, and the bytes of these files and of
+// its uploads in progress.
+type ClientUsage struct {
+	Bytes int64
+	Files int
+}
+
+// quotas accounts for the uploads of each client IP, against
+// Config.ClientQuotaBytes and Config.ClientQuotaFiles.
+type quotas struct {
+	mutex   sync.Mutex
+	clients map[string]*ClientUsage
+}
+
+func (q *quotas) usage(client string) *ClientUsage {
+	if q.clients == nil {
+		q.clients = make(map[string]*ClientUsage)
+	}
+	u := q.clients[client]
+	if u == nil {
+		u = &ClientUsage{}
+		q.clients[client] = u
+	}
+	return u
+}
+
+// reserveFile accounts for a new upload from client, unless the client already
+// stored its quota of files.
+func (q *quotas) reserveFile(conf *Config, client string) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	u := q.usage(client)
+	if conf.ClientQuotaFiles > 0 && u.Files >= conf.ClientQuotaFiles {
+		return &PacketError{errDiskFull, fmt.Sprintf("quota of %v files exceeded", conf.ClientQuotaFiles)}
+	}
+	u.Files++
+	return nil
+}
+
+// reserveBytes accounts for n more bytes uploaded by client, unless that
+// exceeds its quota.
+func (q *quotas) reserveBytes(conf *Config, client string, n int64) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	u := q.usage(client)
+	if conf.ClientQuotaBytes > 0 && u.Bytes+n > conf.ClientQuotaBytes {
+		return &PacketError{errDiskFull, fmt.Sprintf("quota of %vB exceeded", conf.ClientQuotaBytes)}
+	}
+	u.Bytes += n
+	return nil
+}
+
+// check tells if client can upload one more file of size bytes, without
+// reserving anything.
+func (q *quotas) check(conf *Config, client string, size int64) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	u := q.usage(client)
+	if conf.ClientQuotaFiles > 0 && u.Files >= conf.ClientQuotaFiles {
+		return &PacketError{errDiskFull, fmt.Sprintf("quota of %v files exceeded", conf.ClientQuotaFiles)}
+	}
+	if conf.ClientQuotaBytes > 0 && u.Bytes+size > conf.ClientQuotaBytes {
+		return &PacketError{errDiskFull, fmt.Sprintf("quota of %vB exceeded", conf.ClientQuotaBytes)}
+	}
+	return nil
+}
+
+// release gives back what a failed upload reserved, or what a file took once
+// it leaves the store.
+func (q *quotas) release(client string, bytes int64) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	u := q.usage(client)
+	u.Files--
+	u.Bytes -= bytes
+}
+
+// clientIP returns the IP of the address of a client, as the quotas know it.
+func clientIP(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// count accounts for the files of a backend uploaded by clients, such as the
+// files restored from a snapshot.
+func (q *quotas) count(b Backend) {
+	infos, err := b.List()
+	if err != nil {
+		return
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for _, info := range infos {
+		meta, err := b.Metadata(info.Name)
+		if err != nil || meta.Uploader == "" {
+			continue
+		}
+		u := q.usage(clientIP(meta.Uploader))
+		u.Files++
+		u.Bytes += meta.Size
+	}
+}
+
+// snapshot returns the usage of every client.
+func (q *quotas) snapshot() map[string]ClientUsage {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	clients := make(map[string]ClientUsage, len(q.clients))
+	for client, u := range q.clients {
+		clients[client] = *u
+	}
+	return clients
+}
+
+// limitedWriter enforces the size limits of an upload as it is written:
+// Config.MaxFileSize, and the byte quota of the client.
+type limitedWriter struct {
+	writer  blockWriter
+	svr     *Server
+	client  string
+	written int64
+}
+
+func (w *limitedWriter) Write(buf []byte) error {
+	n := int64(len(buf))
+	if err := w.svr.checkUploadSize(w.written + n); err != nil {
+		return err
+	}
+	if err := w.svr.quotas.reserveBytes(w.svr.Conf, w.client, n); err != nil {
+		return err
+	}
+	w.written += n
+	return w.writer.Write(buf)
+}
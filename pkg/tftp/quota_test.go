@@ -0,0 +1,172 @@
+package tftp
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQuotas(t *testing.T) {
+	conf := &Config{}
+	conf.Init()
+	conf.ClientQuotaBytes = 100
+	conf.ClientQuotaFiles = 2
+	var q quotas
+
+	if err := q.reserveFile(conf, "10.0.0.1"); err != nil {
+		t.Error(err)
+	}
+	if err := q.reserveBytes(conf, "10.0.0.1", 60); err != nil {
+		t.Error(err)
+	}
+	if err := q.reserveFile(conf, "10.0.0.1"); err != nil {
+		t.Error(err)
+	}
+	if err := q.reserveBytes(conf, "10.0.0.1", 60); err == nil {
+		t.Error("expected the byte quota to be exceeded")
+	}
+	if err := q.reserveFile(conf, "10.0.0.1"); err == nil {
+		t.Error("expected the file quota to be exceeded")
+	}
+	// other clients have their own quotas:
+	if err := q.reserveFile(conf, "10.0.0.2"); err != nil {
+		t.Error(err)
+	}
+
+	// a failed upload gives back what it reserved:
+	q.release("10.0.0.1", 60)
+	if u := q.snapshot()["10.0.0.1"]; u.Files != 1 || u.Bytes != 0 {
+		t.Error(u)
+	}
+}
+
+func TestLimitedWriter(t *testing.T) {
+	svr := &Server{Conf: &Config{}}
+	svr.Conf.Init()
+	svr.Conf.MaxFileSize = 20
+
+	// the upload is aborted with ERROR 3 once it exceeds the maximum size:
+	client := &uploader{blockSize: 8, windowSize: 1, content: content}
+	conn := &fakeConn{client: client.respond}
+	var received blocks
+	writer := &limitedWriter{writer: &received, svr: svr, client: "10.0.0.1"}
+	err := testTransfer(conn, 1).receive(writer, &PacketAck{0}, noCommit)
+	var pktErr *PacketError
+	if !errors.As(err, &pktErr) || pktErr.Code != errDiskFull {
+		t.Error("expected a disk full error; got", err)
+	}
+	if pkt, ok := conn.sent[len(conn.sent)-1].(*PacketError); !ok || pkt.Code != errDiskFull {
+		t.Error("expected ERROR 3 to be sent; got", conn.sent[len(conn.sent)-1])
+	}
+	if writer.written != 16 || len(received) != 2 {
+		t.Error(writer.written, received)
+	}
+
+	svr.Conf.MaxFileSize = 0
+	svr.Conf.ClientQuotaBytes = 30
+	writer = &limitedWriter{writer: &blocks{}, svr: svr, client: "10.0.0.2"}
+	for i := 0; i < 4; i++ {
+		if err = writer.Write(content[:8]); (err != nil) != (i == 3) {
+			t.Errorf("write #%v: %v", i, err)
+		}
+	}
+}
+
+// uploadAs uploads a file as a client, within its quotas, as
+// ProcessWriteRequest does.
+func uploadAs(svr *Server, client, filename, content string, overwrite Overwrite) error {
+	ip := clientIP(client)
+	if err := svr.quotas.reserveFile(svr.Conf, ip); err != nil {
+		return err
+	}
+	w, err := svr.Files.Put(filename, PutOptions{Overwrite: overwrite, Client: client})
+	if err == nil {
+		limited := &limitedWriter{writer: w, svr: svr, client: ip}
+		if err = limited.Write([]byte(content)); err == nil {
+			err = w.Commit()
+		}
+		if err != nil {
+			w.Abort()
+			svr.quotas.release(ip, limited.written)
+		}
+	} else {
+		svr.quotas.release(ip, 0)
+	}
+	return err
+}
+
+func TestQuotasReleased(t *testing.T) {
+	svr := &Server{Conf: &Config{}}
+	svr.Conf.Init()
+	svr.Conf.ClientQuotaBytes, svr.Conf.ClientQuotaFiles = 25, 3
+	clock := &fakeClock{time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	fm := &FileManager{Released: svr.released, TTL: func(name string) time.Duration {
+		if name == "tmp" {
+			return time.Minute
+		}
+		return 0
+	}, clock: clock.Now}
+	for name, files := range map[string]Backend{"memory": fm,
+		"disk": &DiskBackend{Root: t.TempDir(), Released: svr.released}} {
+		svr.Files = files
+		svr.quotas = quotas{}
+		if err := files.Init(); err != nil {
+			t.Fatal(err)
+		}
+		usage := func() ClientUsage { return svr.quotas.snapshot()["10.0.0.1"] }
+
+		// the file replaced every night gives its share back:
+		replace := Overwrite{Policy: OverwriteReplace}
+		for i := 0; i < 3; i++ {
+			if err := uploadAs(svr, "10.0.0.1:1000", "config", "0123456789", replace); err != nil {
+				t.Fatal(name, i, err)
+			}
+		}
+		if u := usage(); u != (ClientUsage{10, 1}) {
+			t.Error(name, u)
+		}
+		// ... and so do the versions dropped, and the files deleted:
+		versions := Overwrite{Policy: OverwriteVersions, Versions: 1}
+		for i := 0; i < 2; i++ {
+			if err := uploadAs(svr, "10.0.0.1:1000", "config", "01234", versions); err != nil {
+				t.Fatal(name, i, err)
+			}
+		}
+		if u := usage(); u != (ClientUsage{10, 2}) {
+			t.Error(name, u)
+		}
+		if err := uploadAs(svr, "10.0.0.1:1000", "other", strings.Repeat("x", 16), Overwrite{}); err == nil {
+			t.Error(name, "quota of bytes exceeded")
+		}
+		files.Delete("config.~1~")
+		if u := usage(); u != (ClientUsage{5, 1}) {
+			t.Error(name, u)
+		}
+		files.Delete("config")
+		if u := usage(); u != (ClientUsage{}) {
+			t.Error(name, u)
+		}
+	}
+
+	// the files of memory that expire give their share back:
+	svr.Files, svr.quotas = fm, quotas{}
+	if err := uploadAs(svr, "10.0.0.1:1000", "tmp", "0123456789", Overwrite{}); err != nil {
+		t.Fatal(err)
+	}
+	clock.now = clock.now.Add(time.Minute)
+	fm.mutex.Lock()
+	fm.removeExpired()
+	fm.mutex.Unlock()
+	if u := svr.quotas.snapshot()["10.0.0.1"]; u != (ClientUsage{}) {
+		t.Error(u)
+	}
+
+	// the files restored from a snapshot count:
+	uploadAs(svr, "10.0.0.1:1000", "kept", "0123456789", Overwrite{})
+	var restored quotas
+	restored.count(fm)
+	if u := restored.snapshot()["10.0.0.1"]; u != (ClientUsage{10, 1}) {
+		t.Error(u)
+	}
+}
@@ -0,0 +1,230 @@
+package tftp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// RemapRule rewrites the file names requested, before they reach storage, as
+// the rules of the map file of tftp-hpa (-m) do. The rules apply in order,
+// each to the name the previous ones left, if their pattern matches it.
+//
+// Ops are letters: one of the actions r (replace the match with Replacement),
+// l (fold the match to lower case) or a (deny the request with an access
+// violation), and flags: g (every match, rather than the first), i (match
+// regardless of case), e (end: the next rules do not apply if the pattern
+// matches), G (read requests only) and P (write requests only).
+//
+// Windows-style names are converted with the rule {"rg", `\\`, "/"}.
+type RemapRule struct {
+	Ops         string
+	Pattern     string   // regular expression, of the Go regexp syntax
+	Replacement string   `json:",omitempty"` // $1 or ${name} expand to the groups of the match
+	Clients     []string `json:",omitempty"` // CIDRs or IPs the rule applies to; all if none
+}
+
+// remapper applies remap rules. A nil remapper leaves the file names as is.
+type remapper struct {
+	Rules []RemapRule
+	File  string // path of more rules, after Rules; "" for none
+
+	rules []compiledRemap
+}
+
+type compiledRemap struct {
+	RemapRule
+	pattern       *regexp.Regexp
+	clients       []*net.IPNet
+	action        byte
+	global, end   bool
+	reads, writes bool
+}
+
+// Init loads the rules of File, and compiles all of them: an invalid rule fails
+// the server's start.
+func (m *remapper) Init() error {
+	rules := m.Rules
+	if m.File != "" {
+		f, err := os.Open(m.File)
+		if err != nil {
+			return fmt.Errorf("remap rules: %w", err)
+		}
+		defer f.Close()
+		loaded, err := parseRemapRules(f)
+		if err != nil {
+			return fmt.Errorf("remap rules %v: %w", m.File, err)
+		}
+		rules = append(rules[:len(rules):len(rules)], loaded...)
+	}
+	m.rules = nil
+	for _, rule := range rules {
+		compiled, err := compileRemap(rule)
+		if err != nil {
+			return err
+		}
+		m.rules = append(m.rules, compiled)
+	}
+	return nil
+}
+
+// parseRemapRules reads rules, one per line: the ops, the pattern, the
+// replacement of r rules, none to remove the match, and then conditions on
+// the client, from=CIDR. Fields are separated by spaces, and # starts a
+// comment.
+//
+//	rg \\ /                   # Windows-style names
+//	r ^/
+//	ri ^boot/ boot/           # the case of the directory does not matter
+//	r ^pxelinux\.0$ efi/shim.efi from=10.1.0.0/16
+//	a ^private/
+func parseRemapRules(r io.Reader) (rules []RemapRule, err error) {
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		for i, field := range fields {
+			if strings.HasPrefix(field, "#") {
+				fields = fields[:i]
+				break
+			}
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("line %v: no pattern", line)
+		}
+		rule := RemapRule{Ops: fields[0], Pattern: fields[1]}
+		rest := fields[2:]
+		if strings.Contains(rule.Ops, "r") && len(rest) > 0 && !strings.HasPrefix(rest[0], "from=") {
+			rule.Replacement, rest = rest[0], rest[1:]
+		}
+		for _, field := range rest {
+			if !strings.HasPrefix(field, "from=") {
+				return nil, fmt.Errorf("line %v: unexpected %q", line, field)
+			}
+			rule.Clients = append(rule.Clients, strings.TrimPrefix(field, "from="))
+		}
+		if _, err = compileRemap(rule); err != nil {
+			return nil, fmt.Errorf("line %v: %w", line, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+func compileRemap(rule RemapRule) (c compiledRemap, err error) {
+	c.RemapRule = rule
+	caseless := ""
+	for _, op := range rule.Ops {
+		switch op {
+		case 'r', 'l', 'a':
+			if c.action != 0 {
+				return c, fmt.Errorf("remap rule %q: more than one action", rule.Ops)
+			}
+			c.action = byte(op)
+		case 'g':
+			c.global = true
+		case 'i':
+			caseless = "(?i)"
+		case 'e':
+			c.end = true
+		case 'G':
+			c.reads = true
+		case 'P':
+			c.writes = true
+		default:
+			return c, fmt.Errorf("remap rule %q: unknown op %q", rule.Ops, op)
+		}
+	}
+	if c.action == 0 {
+		return c, fmt.Errorf("remap rule %q: no action", rule.Ops)
+	}
+	if !c.reads && !c.writes {
+		c.reads, c.writes = true, true
+	}
+	if c.pattern, err = regexp.Compile(caseless + rule.Pattern); err != nil {
+		return c, fmt.Errorf("remap rule %q: %w", rule.Pattern, err)
+	}
+	for _, client := range rule.Clients {
+		if !strings.Contains(client, "/") {
+			if ip := net.ParseIP(client); ip != nil && ip.To4() != nil {
+				client += "/32"
+			} else {
+				client += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(client)
+		if err != nil {
+			return c, fmt.Errorf("remap rule %q: %w", rule.Pattern, err)
+		}
+		c.clients = append(c.clients, network)
+	}
+	return c, nil
+}
+
+// applies tells whether a rule applies to a request of a client.
+func (c *compiledRemap) applies(op uint16, ip net.IP) bool {
+	if op == OpRRQ && !c.reads || op == OpWRQ && !c.writes {
+		return false
+	}
+	if len(c.clients) == 0 {
+		return true
+	}
+	for _, network := range c.clients {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// remap returns the file name a request of a client is for, or an error
+// wrapping ErrAccess if a rule denies it.
+func (m *remapper) remap(filename string, op uint16, ip net.IP) (string, error) {
+	if m == nil {
+		return filename, nil
+	}
+	for i := range m.rules {
+		rule := &m.rules[i]
+		if !rule.applies(op, ip) {
+			continue
+		}
+		loc := rule.pattern.FindStringSubmatchIndex(filename)
+		if loc == nil {
+			continue
+		}
+		switch {
+		case rule.action == 'a':
+			return "", fmt.Errorf("%v is denied: %w", filename, ErrAccess)
+		case rule.action == 'r' && rule.global:
+			filename = rule.pattern.ReplaceAllString(filename, rule.Replacement)
+		case rule.action == 'r':
+			replacement := rule.pattern.ExpandString(nil, rule.Replacement, filename, loc)
+			filename = filename[:loc[0]] + string(replacement) + filename[loc[1]:]
+		case rule.action == 'l' && rule.global:
+			filename = rule.pattern.ReplaceAllStringFunc(filename, strings.ToLower)
+		case rule.action == 'l':
+			filename = filename[:loc[0]] + strings.ToLower(filename[loc[0]:loc[1]]) + filename[loc[1]:]
+		}
+		if rule.end {
+			break
+		}
+	}
+	return filename, nil
+}
+
+// list returns the rules applied, in order.
+func (m *remapper) list() []RemapRule {
+	rules := []RemapRule{}
+	if m != nil {
+		for _, rule := range m.rules {
+			rules = append(rules, rule.RemapRule)
+		}
+	}
+	return rules
+}
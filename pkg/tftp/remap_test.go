@@ -0,0 +1,104 @@
+package tftp
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRemap(t *testing.T) {
+	m := remapper{Rules: []RemapRule{
+		{Ops: "rg", Pattern: `\\`, Replacement: "/"},
+		{Ops: "r", Pattern: `^/`, Replacement: ""},
+		{Ops: "li", Pattern: `^boot/`},
+		{Ops: "a", Pattern: `^private/`},
+		{Ops: "rP", Pattern: `^(?P<name>[^/]+)$`, Replacement: "uploads/${name}"},
+		{Ops: "re", Pattern: `^pxelinux\.0$`, Replacement: "efi/shim.efi", Clients: []string{"10.1.0.0/16", "::1"}},
+		{Ops: "r", Pattern: `\.0$`, Replacement: ".bin"},
+		{Ops: "lg", Pattern: `X+`},
+	}}
+	if err := m.Init(); err != nil {
+		t.Fatal(err)
+	}
+	lan, other := net.ParseIP("10.1.2.3"), net.ParseIP("192.168.0.1")
+	tests := []struct {
+		filename string
+		op       uint16
+		ip       net.IP
+		remapped string
+	}{
+		{`\Boot\x64\wdsnbp.com`, OpRRQ, other, "boot/x64/wdsnbp.com"},
+		{`BOOT/a.0`, OpRRQ, other, "boot/a.bin"},
+		{`bootX/XaXX`, OpRRQ, other, "bootx/xaxx"},
+		{`pxelinux.0`, OpRRQ, lan, "efi/shim.efi"},
+		{`pxelinux.0`, OpRRQ, net.ParseIP("::1"), "efi/shim.efi"},
+		{`pxelinux.0`, OpRRQ, other, "pxelinux.bin"},
+		{`f`, OpRRQ, other, "f"},
+		{`f`, OpWRQ, other, "uploads/f"},
+		{`private/key`, OpRRQ, other, ""},
+		{`\private\key`, OpWRQ, lan, ""},
+	}
+	for _, test := range tests {
+		remapped, err := m.remap(test.filename, test.op, test.ip)
+		if remapped != test.remapped || test.remapped == "" && !errors.Is(err, ErrAccess) {
+			t.Errorf("%v from %v: expected %q; got %q, %v", test.filename, test.ip, test.remapped,
+				remapped, err)
+		}
+	}
+
+	var none *remapper
+	if remapped, err := none.remap("f", OpRRQ, other); remapped != "f" || err != nil {
+		t.Error(remapped, err)
+	}
+	if len(none.list()) != 0 || len(m.list()) != len(m.Rules) {
+		t.Error(m.list())
+	}
+}
+
+func TestParseRemapRules(t *testing.T) {
+	rules, err := parseRemapRules(strings.NewReader(`
+# Windows-style names:
+rg \\ /
+r ^/
+ri ^boot/ boot/  # any case
+r ^pxelinux\.0$ efi/shim.efi from=10.1.0.0/16 from=10.2.0.0/16
+aG ^private/
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(rules, []RemapRule{
+		{Ops: "rg", Pattern: `\\`, Replacement: "/"},
+		{Ops: "r", Pattern: "^/"},
+		{Ops: "ri", Pattern: "^boot/", Replacement: "boot/"},
+		{Ops: "r", Pattern: `^pxelinux\.0$`, Replacement: "efi/shim.efi", Clients: []string{"10.1.0.0/16", "10.2.0.0/16"}},
+		{Ops: "aG", Pattern: "^private/"},
+	}) {
+		t.Error(rules)
+	}
+
+	for _, text := range []string{"r", "x a", "rl a b", "g a", "r ( b", "r a b from=10.0.0.0/33",
+		"a a b", "r a b c"} {
+		if _, err := parseRemapRules(strings.NewReader(text)); err == nil {
+			t.Errorf("%q accepted", text)
+		}
+	}
+
+	// the rules of the file apply after those of the configuration:
+	path := filepath.Join(t.TempDir(), "remap")
+	os.WriteFile(path, []byte("r ^b$ c\n"), 0644)
+	m := remapper{Rules: []RemapRule{{Ops: "r", Pattern: "^a$", Replacement: "b"}}, File: path}
+	if err = m.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if remapped, _ := m.remap("a", OpRRQ, nil); remapped != "c" {
+		t.Error(remapped)
+	}
+	if err = (&remapper{File: path + ".missing"}).Init(); err == nil {
+		t.Error("missing file loaded")
+	}
+}
@@ -2,20 +2,35 @@ package tftp
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 type Server struct {
-	Conf       *Config      // server configuration
-	Log        *Logger      // for logging to files and console
-	Files      *FileManager // file handling is delegated to FileManager
+	Conf       *Config // server configuration
+	Log        *Logger // for logging to files and console
+	Files      Backend // file handling is delegated to a Backend, a FileManager by default
 	ListenSock *net.UDPConn
 
 	Running              bool
 	ReceivedRequestCount uint
+	Uploads              uploadHistory // the last uploads, and the overwrite policy applied
+
+	quotas quotas // what each client stores
+
+	multicastMutex  sync.Mutex                 // protects the 2 maps below
+	multicastGroups map[string]*multicastGroup // by file name and block size
+	multicastPorts  map[uint16]bool            // ports in use by multicast groups
+
+	templates *generator // nil if no file is generated
+	remap     *remapper  // nil if no file name is remapped
 }
 
 func (svr *Server) Init() (err error) {
@@ -37,12 +52,51 @@ func (svr *Server) Init() (err error) {
 		return
 	}
 
-	// Init file manager:
-	svr.Files = new(FileManager)
+	// Init file storage:
+	if svr.Files == nil {
+		memory := &FileManager{Budget: svr.Conf.MemoryBudget, EvictLRU: svr.Conf.EvictLRU,
+			TTL: svr.Conf.ttl, SnapshotFile: svr.Conf.SnapshotFile,
+			SnapshotInterval: svr.Conf.SnapshotInterval, Released: svr.released}
+		if svr.Conf.StorageRoot != "" {
+			svr.Files = &DiskBackend{Root: svr.Conf.StorageRoot,
+				CreateDirectories: svr.Conf.CreateDirectories, Released: svr.released}
+		} else if len(svr.Conf.Archives) > 0 {
+			svr.Files = &ArchiveBackend{Archives: svr.Conf.Archives, Root: svr.Conf.ArchiveRoot}
+		} else {
+			svr.Files = memory
+		}
+		if _, ok := svr.Files.(*FileManager); !ok && svr.Conf.Overlay {
+			svr.Files = &OverlayBackend{Lower: svr.Files, Upper: memory}
+		}
+		if svr.Conf.Origin != "" {
+			svr.Files = &OriginBackend{Store: svr.Files, URL: svr.Conf.Origin,
+				CacheBytes: svr.Conf.OriginCacheBytes, MaxAge: svr.Conf.OriginMaxAge}
+		}
+	}
 	err = svr.Files.Init()
 	if err != nil {
 		return
 	}
+	// The files restored from a snapshot count in the quotas of their uploaders:
+	if fm, ok := svr.memory(); ok {
+		svr.quotas.count(fm)
+	}
+
+	// Init file name remapping:
+	if len(svr.Conf.RemapRules) > 0 || svr.Conf.RemapFile != "" {
+		svr.remap = &remapper{Rules: svr.Conf.RemapRules, File: svr.Conf.RemapFile}
+		if err = svr.remap.Init(); err != nil {
+			return
+		}
+	}
+
+	// Init file generation from templates:
+	if len(svr.Conf.Templates) > 0 {
+		svr.templates = &generator{Rules: svr.Conf.Templates, Inventory: svr.Conf.InventoryFile}
+		if err = svr.templates.Init(); err != nil {
+			return
+		}
+	}
 
 	//
 	go svr.AdminRestInterface()
@@ -63,12 +117,15 @@ func (svr *Server) DeInit() (err error) {
 	if svr.Conf != nil {
 		svr.Conf.DeInit()
 	}
+	// the files are saved before the log is closed, to log any error:
+	if svr.Files != nil {
+		if err = svr.Files.DeInit(); err != nil {
+			log.Println(err)
+		}
+	}
 	if svr.Log != nil {
 		svr.Log.DeInit()
 	}
-	if svr.Files != nil {
-		svr.Files.DeInit()
-	}
 	if svr.ListenSock != nil {
 		svr.ListenSock.Close()
 	}
@@ -91,8 +148,97 @@ func (svr *Server) AdminRestInterface() {
 	})
 	http.HandleFunc("/clear", func(w http.ResponseWriter, r *http.Request) {
 		log.Println("[REST] /clear")
-		for k := range svr.Files.files {
-			delete(svr.Files.files, k)
+		c, ok := svr.Files.(clearer)
+		if !ok {
+			fmt.Fprint(w, "the files cannot be cleared")
+			return
+		}
+		if err := c.Clear(); err != nil {
+			fmt.Fprint(w, err.Error())
+		}
+	})
+	http.HandleFunc("/files", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		limit := browseLimit
+		if s := query.Get("limit"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 0 {
+				http.Error(w, "invalid limit "+s, http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+		listing, err := svr.Files.Browse(query.Get("prefix"), query.Get("after"), limit)
+		switch {
+		case errors.Is(err, ErrNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errors.Is(err, ErrAccess):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		default:
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			json.NewEncoder(w).Encode(listing)
+		}
+	})
+	http.HandleFunc("/metadata", func(w http.ResponseWriter, r *http.Request) {
+		meta, err := svr.Files.Metadata(r.URL.Query().Get("file"))
+		switch {
+		case errors.Is(err, ErrNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errors.Is(err, ErrAccess):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		default:
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			json.NewEncoder(w).Encode(meta)
+		}
+	})
+	http.HandleFunc("/mounts", func(w http.ResponseWriter, r *http.Request) {
+		archives, ok := svr.archives()
+		if !ok {
+			http.Error(w, "no archive storage", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(archives.Mounted())
+	})
+	http.HandleFunc("/mount", func(w http.ResponseWriter, r *http.Request) {
+		log.Println("[REST] /mount", r.URL.RawQuery)
+		archives, ok := svr.archives()
+		if !ok {
+			http.Error(w, "no archive storage", http.StatusNotFound)
+			return
+		}
+		query := r.URL.Query()
+		if err := archives.MountUnder(query.Get("dir"), query.Get("archive")); errors.Is(err, ErrAccess) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	})
+	http.HandleFunc("/unmount", func(w http.ResponseWriter, r *http.Request) {
+		log.Println("[REST] /unmount", r.URL.RawQuery)
+		archives, ok := svr.archives()
+		if !ok {
+			http.Error(w, "no archive storage", http.StatusNotFound)
+			return
+		}
+		if err := archives.Unmount(r.URL.Query().Get("dir")); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+		}
+	})
+	http.HandleFunc("/remap", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(svr.remap.list())
+	})
+	http.HandleFunc("/usage", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if b, err := json.Marshal(svr.usage()); err != nil {
+			fmt.Fprint(w, err.Error())
+		} else {
+			fmt.Fprint(w, string(b))
 		}
 	})
 	log.Println("Admin REST Interface at", svr.Conf.AdminRestAddress)
@@ -100,13 +246,85 @@ func (svr *Server) AdminRestInterface() {
 
 }
 
+// Usage is the storage used, as reported by the admin interface.
+type Usage struct {
+	Files        int
+	Bytes        int64
+	MemoryBudget int64                  `json:",omitempty"`
+	MemoryUsed   int64                  // by the files in memory and the uploads in progress
+	Clients      map[string]ClientUsage // by IP
+}
+
+// archives returns the backend of the archives the server mounts, if any,
+// under an overlay or an origin or not.
+func (svr *Server) archives() (*ArchiveBackend, bool) {
+	for files := svr.Files; ; {
+		switch b := files.(type) {
+		case *ArchiveBackend:
+			return b, true
+		case *OverlayBackend:
+			files = b.Lower
+		case *OriginBackend:
+			files = b.Store
+		default:
+			return nil, false
+		}
+	}
+}
+
+// memory returns the in-memory store of the uploads, if any, under an overlay
+// or an origin or not.
+func (svr *Server) memory() (*FileManager, bool) {
+	for files := svr.Files; ; {
+		switch b := files.(type) {
+		case *FileManager:
+			return b, true
+		case *OverlayBackend:
+			files = b.Upper
+		case *OriginBackend:
+			files = b.Store
+		default:
+			return nil, false
+		}
+	}
+}
+
+// clearer is a Backend that /clear empties: a FileManager deletes its files, an
+// OverlayBackend only clears its upper layer, and a DiskBackend refuses.
+type clearer interface {
+	Clear() error
+}
+
+// downloadCounter is a Backend that counts the downloads of its files in their
+// Metadata: the server tells it once a client received a whole file.
+type downloadCounter interface {
+	countDownload(filename string)
+}
+
+// browseLimit is the number of entries of a page of /files, unless the request
+// sets one.
+const browseLimit = 100
+
+func (svr *Server) usage() (u Usage) {
+	root, err := svr.Files.Browse("", "", 1)
+	if err != nil {
+		log.Println("[REST] /usage:", err)
+	}
+	u.Files, u.Bytes = root.Files, root.Bytes
+	if fm, ok := svr.memory(); ok {
+		u.MemoryBudget, u.MemoryUsed = fm.Budget, fm.memoryUsed()
+	}
+	u.Clients = svr.quotas.snapshot()
+	return
+}
+
 func (svr *Server) AcceptLoop() (err error) {
 	logHdr := fmt.Sprintf("[%v] ", svr.ListenSock.LocalAddr())
 	log.Println(logHdr, "Ready to accept clients..")
 	var pkt_buf []byte = make([]byte, MaxPacketSize)
 	svr.Running = true
 	for svr.Running {
-		pkt, addr, err := readPacket(svr.ListenSock, pkt_buf, 5)
+		pkt, addr, err := readPacket(svr.ListenSock, pkt_buf, svr.Conf.SocketTimeout)
 		if err != nil { // error on socket
 			return err
 		}
@@ -147,11 +365,20 @@ func (svr *Server) ProcessRequest(reqPacket *PacketRequest, clientAddr *net.UDPA
 	// and
 	// 2) I am not certain it is universal across all IP stacks that a UDP socket can
 	// be reading/blocked and writing at the same time from different threads.
-	if reqPacket.Mode != "octet" {
+	// Mode names are case-insensitive:
+	switch strings.ToLower(reqPacket.Mode) {
+	case "octet", "netascii":
+	case "mail":
+		svr.SendError(clientAddr, errIllegalOp, "Mode mail is obsolete and not supported")
+		// log the request anyways:
+		svr.Log.LogRequest(clientAddr.String(), reqPacket.String(),
+			"Ignored: client request in mail mode.")
+		return
+	default:
 		svr.SendError(clientAddr, errIllegalOp, "Mode not supported")
 		// log the request anyways:
 		svr.Log.LogRequest(clientAddr.String(), reqPacket.String(),
-			"Ignored: client request not in octet mode.")
+			"Ignored: client request not in octet or netascii mode.")
 		return
 	}
 	if reqPacket.Op != OpRRQ && reqPacket.Op != OpWRQ {
@@ -169,7 +396,7 @@ func (svr *Server) processRequest(reqPacket *PacketRequest, clientAddr *net.UDPA
 	// Create a session socket 'sock' for processing this request:
 	// Exchange with this client is done with this new socket; The listen socket
 	// svr.ListenSock is reserved for listening for incoming requests.
-	sock, err := createSessionSocket(svr.Conf.LocalInterface, clientAddr)
+	sock, err := createSessionSocket(svr.Conf.LocalInterface)
 	if err != nil {
 		log.Println("ERROR: Could not create socket for session with ",
 			clientAddr, ":", err)
@@ -187,258 +414,234 @@ func (svr *Server) processRequest(reqPacket *PacketRequest, clientAddr *net.UDPA
 
 	// log the request:
 	svr.Log.LogRequest(clientAddr.String(), reqPacket.String(),
-		fmt.Sprintf("Processing request %v<-->%v", sock.LocalAddr(), sock.RemoteAddr()))
+		fmt.Sprintf("Processing request %v<-->%v", sock.LocalAddr(), clientAddr))
+
+	// The file name is remapped before anything looks it up:
+	filename, err := svr.remap.remap(reqPacket.Filename, reqPacket.Op, clientAddr.IP)
+	if err != nil {
+		svr.SendError(clientAddr, fileErrorCode(err, errAccessViolation), err.Error())
+		log.Printf("[%v] session with %v refused: %v", sock.LocalAddr(),
+			clientAddr, err.Error())
+		return
+	}
+	if filename != reqPacket.Filename {
+		log.Printf("[%v] %v remapped to %v", sock.LocalAddr(), reqPacket.Filename, filename)
+		reqPacket.Filename = filename
+	}
+
+	ses := &session{sock: sock, clientAddr: clientAddr, req: reqPacket,
+		blockSize: int(svr.Conf.DataPayloadSize), timeout: svr.Conf.SocketTimeout,
+		windowSize: 1, rollover: svr.Conf.BlockRollover}
+
+	// A file generated from a template is rendered first, for the options to
+	// tell its size:
+	if err = svr.generate(ses); err != nil {
+		pktErr := asPacketError(err, errNotDefined)
+		svr.SendError(clientAddr, pktErr.Code, pktErr.Msg)
+		log.Printf("[%v] session with %v refused: %v", sock.LocalAddr(),
+			clientAddr, err.Error())
+		return
+	}
+
+	// Option negotiation (RFC 2347): the client is told which of its options
+	// were accepted with an OACK, sent in place of the first ACK/DATA below.
+	if err = svr.negotiate(ses, optionHandlers); err != nil {
+		pktErr := asPacketError(err, errOptionNegotiation)
+		svr.SendError(clientAddr, pktErr.Code, pktErr.Msg)
+		log.Printf("[%v] session with %v refused: %v", sock.LocalAddr(),
+			clientAddr, err.Error())
+		return
+	}
 
 	switch reqPacket.Op {
 	case OpRRQ:
-		err = svr.ProcessReadRequest(sock, reqPacket, clientAddr)
+		err = svr.ProcessReadRequest(ses)
 
 	case OpWRQ:
-		err = svr.ProcessWriteRequest(sock, reqPacket, clientAddr)
+		err = svr.ProcessWriteRequest(ses)
 	default:
 		// spurious request types were already handled from ProcessRequest()
 	}
-	if err != nil {
+	var abort *clientAbort
+	if errors.As(err, &abort) {
+		// the client gave up: record its reason
+		svr.Log.LogRequest(clientAddr.String(), reqPacket.String(),
+			fmt.Sprintf("Aborted by client: error %v: %v", abort.pkt.Code, abort.pkt.Msg))
+	} else if err != nil {
 		log.Printf("[%v] session with %v aborted: %v", sock.LocalAddr(),
 			clientAddr, err.Error())
 	}
 
 }
 
-func (svr *Server) ProcessWriteRequest(sock *net.UDPConn, req *PacketRequest, clientAddr *net.UDPAddr) (err error) {
+func (svr *Server) ProcessWriteRequest(ses *session) (err error) {
+	req, clientAddr := ses.req, ses.clientAddr
+	overwrite := svr.Conf.overwrite(req.Filename)
+	record := UploadRecord{Time: time.Now(), Client: clientAddr.String(),
+		Filename: req.Filename, Policy: overwrite.Policy}
+	defer func() {
+		if err != nil {
+			record.Error = err.Error()
+		}
+		svr.Uploads.add(record)
+	}()
 
-	// Files.Put() returns an iterator on the file to write:
-	fileIter, err := svr.Files.Put(req.Filename)
-	if err != nil {
-		svr.SendError(clientAddr, errFileAlreadyExists, err.Error())
+	// The client's quotas are checked as the upload goes:
+	client := clientAddr.IP.String()
+	if err = svr.quotas.reserveFile(svr.Conf, client); err != nil {
+		svr.SendError(clientAddr, errDiskFull, err.Error())
 		return err
 	}
-
-	for blockNumber := uint16(1); ; blockNumber++ {
-
-		dataBuf, err := lockStepReceiveData(sock, blockNumber, clientAddr,
-			svr.Conf.MaxSendTries, svr.Conf.socketTimeoutSecs)
+	limited := &limitedWriter{svr: svr, client: client}
+	defer func() {
 		if err != nil {
-			return err
+			svr.quotas.release(client, limited.written)
 		}
-		fileIter.Write(dataBuf)
-		// TODO: set a maximum file size, otherwise this for loop can go on forever
-
-		if uint16(len(dataBuf)) < svr.Conf.DataPayloadSize {
-			// the payload is not the max size => it means it was the last block in the transmission.
+	}()
 
-			// we need to send the final ACK (and we don't check if it is received)
-			sendAck(sock, blockNumber, clientAddr, svr.Conf.socketTimeoutSecs)
+	// Files.Put() returns a writer on the file to store:
+	file, err := svr.Files.Put(req.Filename, PutOptions{Overwrite: overwrite, Client: clientAddr.String()})
+	if err != nil {
+		svr.SendError(clientAddr, fileErrorCode(err, errAccessViolation), err.Error())
+		return err
+	}
+	limited.writer = file
+	var writer blockWriter = limited
+	var netascii *netasciiWriter
+	if ses.netascii() {
+		netascii = newNetasciiWriter(limited)
+		writer = netascii
+	}
 
-			log.Println("Done: Received file", req.Filename, "from", clientAddr)
-			break
+	// The first data block is requested with ACK#0, or with the OACK if
+	// options were negotiated:
+	var first Packet = &PacketAck{0}
+	if len(ses.oack) > 0 {
+		first = &PacketOAck{ses.oack}
+	}
+	// The upload is staged by the backend, and only stored once the last block
+	// is received: a failed session leaves no partial file behind.
+	commit := func() error {
+		if netascii != nil {
+			if err := netascii.Flush(); err != nil {
+				return asPacketError(err, fileErrorCode(err, errAccessViolation))
+			}
+		}
+		if err := file.Commit(); err != nil {
+			return asPacketError(err, fileErrorCode(err, errAccessViolation))
 		}
+		return nil
+	}
+	if err = newTransfer(ses, svr.Conf.MaxSendTries).receive(writer, first, commit); err != nil {
+		if e := file.Abort(); e != nil {
+			log.Printf("aborting the upload of %v: %v", req.Filename, e)
+		}
+		return err
 	}
+
+	record.StoredAs = file.Name()
+	log.Println("Done: Received file", req.Filename, "from", clientAddr, "stored as", file.Name())
 	return nil
 }
 
-func sendAck(sock *net.UDPConn, blockNumber uint16, clientAddr *net.UDPAddr,
-	socketTimeoutSecs uint) (timeout bool, err error) {
-	ackPacket := PacketAck{blockNumber}
-	if n, e := writeBuf(sock, ackPacket.Serialize(), socketTimeoutSecs); e != nil {
-		return false, fmt.Errorf("sending ACK: %w", e) // fail on write error.
-	} else {
-		if n == 0 {
-			return true, nil // Timed out
-		}
-		log.Printf("[%v] Sent ACK#%v to %v (%vB)\n", sock.LocalAddr(), blockNumber, clientAddr, n)
-	}
-	return false, nil
+// released gives back its share of the quotas of a client to a file it
+// uploaded, as the file leaves the store.
+func (svr *Server) released(uploader string, size int64) {
+	svr.quotas.release(clientIP(uploader), size)
 }
-func lockStepReceiveData(sock *net.UDPConn, blockNumber uint16, clientAddr *net.UDPAddr,
-	MaxSendTries uint, socketTimeoutSecs uint) ([]byte, error) {
-
-	//  Try loop
-	for triesLeft := MaxSendTries; triesLeft >= 0; triesLeft-- {
-		if triesLeft == 0 {
-			return nil, fmt.Errorf(
-				"no data from client after sending ack#%v %v times",
-				blockNumber-1, MaxSendTries)
-		}
 
-		// Send the ack for the previous block.
-		// In the case of the first block, we are thus sending an ACK for block #0 , which is
-		// TFTP's way to initiate the lockstep transmission:
+// fileErrorCode returns the TFTP error code that reports a Backend error, code
+// if it is not one of the Backend errors.
+func fileErrorCode(err error, code uint16) uint16 {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return errFileNotFound
+	case errors.Is(err, ErrExists):
+		return errFileAlreadyExists
+	case errors.Is(err, ErrAccess):
+		return errAccessViolation
+	case errors.Is(err, ErrFull):
+		return errDiskFull
+	case errors.Is(err, ErrUnavailable):
+		return errNotDefined
+	}
+	return code
+}
 
-		if timeout, e := sendAck(sock, blockNumber-1, clientAddr, socketTimeoutSecs); e != nil {
-			return nil, e // fail on write error.
-		} else {
-			if timeout {
-				continue // Timed out. try again
-			}
-		}
+// checkUploadSize fails with a "disk full" error if the server cannot store
+// an upload of size bytes.
+func (svr *Server) checkUploadSize(size int64) error {
+	if svr.Conf.MaxFileSize > 0 && size > svr.Conf.MaxFileSize {
+		return &PacketError{errDiskFull, fmt.Sprintf(
+			"file too large: %vB, the maximum is %vB", size, svr.Conf.MaxFileSize)}
+	}
+	return nil
+}
 
-		// Receive the packet:
-		var readPacketBuf = make([]byte, MaxPacketSize)
-		if responsePkt, _, e := readPacket(sock, readPacketBuf, socketTimeoutSecs); e != nil {
-			return nil, e // fail on read error
-		} else {
-			if responsePkt == nil {
-				continue // Timed out. try again
-			} else {
-				resend, err := processDataPacket(blockNumber, responsePkt, clientAddr)
-				if err != nil {
-					return nil, err // invalid response
-				}
-				if resend {
-					continue // client needs a resend of the previous ACK
-				}
-				// success: we received a data packet,
-				// and its block number is the previous one + 1 .
-				dataBuf := (*responsePkt).(*PacketData).Data
-				log.Printf("[%v] Received data block#%v from %v %vB\n",
-					sock.LocalAddr(), blockNumber, clientAddr, len(dataBuf))
-				return dataBuf, nil
-			}
+// checkTransferSize fails with a "disk full" error if the server cannot store
+// an upload of size bytes from client, as declared up-front with the tsize
+// option: over Config.MaxFileSize, over the quotas of the client, or over the
+// free memory budget.
+func (svr *Server) checkTransferSize(client string, size int64) error {
+	if err := svr.checkUploadSize(size); err != nil {
+		return err
+	}
+	if err := svr.quotas.check(svr.Conf, client, size); err != nil {
+		return err
+	}
+	if fm, ok := svr.memory(); ok {
+		if free := fm.free(); free >= 0 && size > free {
+			return &PacketError{errDiskFull, fmt.Sprintf(
+				"file too large: %vB, %vB of memory left", size, free)}
 		}
-
 	}
-	return nil, nil // unreachable.
+	return nil
 }
-func processDataPacket(blockNumber uint16, responsePkt *Packet,
-	clientAddr *net.UDPAddr) (resend bool, err error) {
-	switch (*responsePkt).(type) {
+
+// packetString describes a packet sent or received by a session in the logs.
+func packetString(pkt Packet) string {
+	switch p := pkt.(type) {
 	case *PacketData:
-		dataPkt := (*responsePkt).(*PacketData)
-		switch dataPkt.BlockNum {
-		case blockNumber:
-			return false, nil
-		case blockNumber - 1:
-			return true, nil
-		default:
-			return false, fmt.Errorf("invalid data packet from client: "+
-				"current block is #%v,client asked for #%v",
-				blockNumber, dataPkt.BlockNum)
-		}
+		return fmt.Sprintf("data block#%v", p.BlockNum)
+	case *PacketAck:
+		return fmt.Sprintf("ACK#%v", p.BlockNum)
+	case *PacketOAck:
+		return p.String()
+	case *PacketError:
+		return fmt.Sprintf("ERROR %v (%v)", p.Code, p.Msg)
 	default:
-		return false, fmt.Errorf(
-			"received non data packet after sending ACK#%blockNumber: %v",
-			blockNumber, responsePkt)
+		return fmt.Sprintf("%T", pkt)
 	}
 }
 
-func (svr *Server) ProcessReadRequest(sock *net.UDPConn, req *PacketRequest,
-	clientAddr *net.UDPAddr) (err error) {
+func (svr *Server) ProcessReadRequest(ses *session) (err error) {
+	req, clientAddr := ses.req, ses.clientAddr
 
-	// Files.Get() returns an iterator on the file to read:
-	var fileIter *FileIterator
-	fileIter, err = svr.Files.Get(req.Filename, int(svr.Conf.DataPayloadSize))
-	if err != nil {
-		svr.SendError(clientAddr, errFileNotFound, err.Error())
+	// Files.Get() returns a reader on the file to send, unless it was
+	// generated:
+	var file FileReader
+	if ses.generated != nil {
+		file = newFileReader(ses.generated, ses.blockSize)
+	} else if file, err = svr.Files.Get(req.Filename, ses.blockSize); err != nil {
+		svr.SendError(clientAddr, fileErrorCode(err, errFileNotFound), err.Error())
 		return err
 	}
-
-	// Read loop:
-	var lastSentBufLen int
-	for blockNumber := uint16(1); ; blockNumber++ {
-
-		// Retrieve the next buffer of data from the file:
-		var fileBuf []byte
-		fileBuf, err = fileIter.Read()
-		if err != nil {
-			svr.SendError(clientAddr, errAccessViolation, err.Error())
-			return err
-		}
-
-		// fileBuf==nil means that there is no more data to be sent ;
-		// However, if the last packet we sent had a payload size equal to the
-		// maximum payload size, then we send an extra empty packet to signify
-		// the end of transmission.
-		// Also: same logic applies for an empty file: we need to send at least
-		// one data packet.
-		if fileBuf == nil {
-			if lastSentBufLen == int(svr.Conf.DataPayloadSize) || blockNumber == 1 {
-				fileBuf = []byte{}
-			} else {
-				break
-			}
-		}
-
-		// Send the data packet and handle its ACK and also other scenarios:
-		dataPacket := PacketData{blockNumber, fileBuf}
-		if err = lockStepSendData(sock, &dataPacket, clientAddr, svr.Conf.MaxSendTries,
-			svr.Conf.socketTimeoutSecs); err != nil {
-			return err
-		}
-
-		// we need to remember how big a payload we just sent:
-		lastSentBufLen = len(fileBuf)
+	if ses.multicast {
+		return svr.processMulticastRead(ses, file) // the group closes the file
+	}
+	defer file.Close()
+	var reader blockReader = file
+	if ses.netascii() {
+		reader = newNetasciiReader(file, ses.blockSize)
 	}
 
-	log.Println("Done: Sent file", req.Filename, "to", clientAddr)
-	return
-}
-
-func lockStepSendData(sock *net.UDPConn, dataPkt *PacketData, clientAddr *net.UDPAddr,
-	MaxSendTries uint, socketTimeoutSecs uint) error {
-
-	writePacketBuf := dataPkt.Serialize()
-
-	//  Try loop
-	for triesLeft := MaxSendTries; triesLeft >= 0; triesLeft-- {
-		if triesLeft == 0 {
-			return fmt.Errorf(
-				"no response from client after sending data block#%v %v times",
-				dataPkt.BlockNum, MaxSendTries)
-		}
-
-		// Send the packet:
-		if n, e := writeBuf(sock, writePacketBuf, socketTimeoutSecs); e != nil {
-			return fmt.Errorf("writing to client: %w", e) // fail on write error.
-		} else {
-			if n == 0 {
-				continue // Timed out. try again
-			}
-			log.Printf("[%v] Sent data block#%v to %v (%vB)\n", sock.LocalAddr(), dataPkt.BlockNum, clientAddr, n)
-		}
-
-		// Read the ack:
-		var readPacketBuf = make([]byte, MaxPacketSize)
-		if responsePkt, _, e := readPacket(sock, readPacketBuf, socketTimeoutSecs); e != nil {
-			return e // fail on read error
-		} else {
-			if responsePkt == nil {
-				continue // Timed out. try again
-			} else {
-				resend, err := processAckPacket(dataPkt, responsePkt, clientAddr)
-				if err != nil {
-					return err // invalid response
-				}
-				if resend {
-					continue // client needs a resend
-				}
-				log.Printf("[%v] Received ACK#%v from %v\n", sock.LocalAddr(),
-					dataPkt.BlockNum, clientAddr)
-				return nil // success
-			}
-		}
+	if err = newTransfer(ses, svr.Conf.MaxSendTries).send(reader, ses.oack); err != nil {
+		return err
 	}
-	return nil // unreachable.
-}
 
-func processAckPacket(dataPacket *PacketData, responsePkt *Packet,
-	clientAddr *net.UDPAddr) (resend bool, err error) {
-	switch (*responsePkt).(type) {
-	case *PacketAck:
-		ackPkt := (*responsePkt).(*PacketAck)
-		switch ackPkt.BlockNum {
-		case dataPacket.BlockNum:
-			return false, nil
-		case dataPacket.BlockNum - 1:
-			return true, nil
-		default:
-			return false, fmt.Errorf("invalid ACK from client: "+
-				"current block is #%v,client asked for #%v",
-				dataPacket.BlockNum, ackPkt.BlockNum)
-		}
-	default:
-		return false, fmt.Errorf(
-			"received non ACK after sending data block #%v: %v",
-			dataPacket.BlockNum, responsePkt)
+	if counter, ok := svr.Files.(downloadCounter); ok && ses.generated == nil {
+		counter.countDownload(req.Filename)
 	}
+	log.Println("Done: Sent file", req.Filename, "to", clientAddr)
+	return
 }
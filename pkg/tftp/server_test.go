@@ -1,6 +1,11 @@
 package tftp
 
-import "testing"
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
 
 func TestServer(t *testing.T) {
 	svr := Server{}
@@ -11,3 +16,212 @@ func TestServer(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+// readFile reads a file from the server, and answers the last block with an
+// ERROR rather than its ACK unless ack is set.
+func readFile(svr *Server, filename string, ack bool) error {
+	sock, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return err
+	}
+	defer sock.Close()
+	done := make(chan bool)
+	go func() {
+		svr.processRequest(&PacketRequest{OpRRQ, filename, "octet", nil}, sock.LocalAddr().(*net.UDPAddr))
+		close(done)
+	}()
+	buf := make([]byte, MaxPacketSize)
+	for {
+		sock.SetReadDeadline(time.Now().Add(time.Second))
+		n, addr, err := sock.ReadFromUDP(buf)
+		if err != nil {
+			return err
+		}
+		pkt, err := ParsePacket(buf[:n])
+		if err != nil {
+			return err
+		}
+		data, ok := pkt.(*PacketData)
+		if !ok {
+			return pkt.(*PacketError)
+		}
+		last := len(data.Data) < 512
+		var reply Packet = &PacketAck{data.BlockNum}
+		if last && !ack {
+			reply = &PacketError{errNotDefined, "disk full"}
+		}
+		sock.WriteToUDP(reply.Serialize(), addr)
+		if last {
+			<-done
+			return nil
+		}
+	}
+}
+
+func TestDownloadCount(t *testing.T) {
+	svr := Server{Conf: &Config{}, Log: &Logger{}, Files: &FileManager{}}
+	svr.Conf.Init()
+	svr.Conf.LocalInterface = "127.0.0.1"
+	svr.Files.Init()
+	if err := putThenGet(svr.Files, "f", strings.Repeat("x", 1000)); err != nil {
+		t.Fatal(err)
+	}
+
+	// only the downloads the clients acknowledged count:
+	for _, ack := range []bool{true, false, true} {
+		if err := readFile(&svr, "f", ack); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if meta, _ := svr.Files.Metadata("f"); meta.Downloads != 2 {
+		t.Error(meta.Downloads)
+	}
+}
+
+// netasciiClient is a client of the server, which requests files in netascii
+// mode with a block size of 8.
+type netasciiClient struct {
+	t    *testing.T
+	sock *net.UDPConn
+	addr *net.UDPAddr // of the session
+	done chan bool
+}
+
+func startNetascii(t *testing.T, svr *Server, op uint16, filename string) *netasciiClient {
+	sock, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &netasciiClient{t: t, sock: sock, done: make(chan bool)}
+	req := &PacketRequest{op, filename, "netascii", []Option{{"blksize", "8"}}}
+	go func() {
+		svr.processRequest(req, sock.LocalAddr().(*net.UDPAddr))
+		close(c.done)
+	}()
+	// the block size is acknowledged:
+	if oack, ok := c.receive().(*PacketOAck); !ok || len(oack.Options) != 1 ||
+		oack.Options[0] != (Option{"blksize", "8"}) {
+		t.Fatal("expected an OACK; got", oack)
+	}
+	return c
+}
+
+func (c *netasciiClient) receive() Packet {
+	buf := make([]byte, MaxPacketSize)
+	c.sock.SetReadDeadline(time.Now().Add(time.Second))
+	n, addr, err := c.sock.ReadFromUDP(buf)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.addr = addr
+	pkt, err := ParsePacket(buf[:n])
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return pkt
+}
+
+func (c *netasciiClient) send(pkt Packet) {
+	c.sock.WriteToUDP(pkt.Serialize(), c.addr)
+}
+
+// close waits for the end of the session.
+func (c *netasciiClient) close() {
+	<-c.done
+	c.sock.Close()
+}
+
+func TestNetascii(t *testing.T) {
+	svr := Server{Conf: &Config{}, Log: &Logger{}, Files: &FileManager{}}
+	svr.Conf.Init()
+	svr.Conf.LocalInterface = "127.0.0.1"
+	svr.Files.Init()
+	// the CR LF of the first line ends up across two blocks:
+	blocks := []string{"1234567\r", "\nabc\r\x00de", "f\r\n"}
+	if err := putThenGet(svr.Files, "f", "1234567\nabc\rdef\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	c := startNetascii(t, &svr, OpRRQ, "f")
+	c.send(&PacketAck{0})
+	for i, block := range blocks {
+		data, ok := c.receive().(*PacketData)
+		if !ok || data.BlockNum != uint16(i+1) || string(data.Data) != block {
+			t.Fatalf("block #%v: expected %q; got %v", i+1, block, data)
+		}
+		c.send(&PacketAck{data.BlockNum})
+	}
+	c.close()
+
+	// the upload decodes them back, and keeps the CR left at its end:
+	c = startNetascii(t, &svr, OpWRQ, "g")
+	blocks[2] = "f\r"
+	for i, block := range blocks {
+		c.send(&PacketData{uint16(i + 1), []byte(block)})
+		if ack, ok := c.receive().(*PacketAck); !ok || ack.BlockNum != uint16(i+1) {
+			t.Fatalf("block #%v: expected its ACK; got %v", i+1, ack)
+		}
+	}
+	c.close()
+	if err := getContent(svr.Files, "g", "1234567\nabc\rdef\r"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	svr := Server{Files: &FileManager{Budget: 100}}
+	svr.Files.Init()
+
+	// the files overwritten give their bytes back:
+	for _, overwrite := range []Overwrite{{}, {Policy: OverwriteReplace}, {Policy: OverwriteReplace},
+		{Policy: OverwriteVersions, Versions: 1}, {Policy: OverwriteVersions, Versions: 1}} {
+		if _, err := upload(svr.Files, "f", "0123456789", overwrite); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if u := svr.usage(); u.Files != 2 || u.Bytes != 20 || u.MemoryBudget != 100 || u.MemoryUsed != 20 {
+		t.Error(u)
+	}
+}
+
+func TestBlockRollover(t *testing.T) {
+	tests := []struct {
+		blockNumber uint64
+		rollover    uint16
+		wire        uint16
+	}{
+		{0, 0, 0},
+		{1, 0, 1},
+		{65535, 0, 65535},
+		{65536, 0, 0},
+		{65537, 0, 1},
+		{2*65536 + 7, 0, 7},
+		{0, 1, 0},
+		{1, 1, 1},
+		{65535, 1, 65535},
+		{65536, 1, 1},
+		{65537, 1, 2},
+		{2*65535 + 7, 1, 7},
+	}
+	for _, test := range tests {
+		if wire := wireBlockNumber(test.blockNumber, test.rollover); wire != test.wire {
+			t.Errorf("block %v, rollover %v: expected #%v; got #%v", test.blockNumber,
+				test.rollover, test.wire, wire)
+		}
+		for _, d := range []int64{-3, -1, 0, 1, 3} {
+			if int64(test.blockNumber)+d < int64(test.rollover) {
+				continue
+			}
+			wire := wireBlockNumber(uint64(int64(test.blockNumber)+d), test.rollover)
+			if actual := blockDistance(wire, test.blockNumber, test.rollover); actual != d {
+				t.Errorf("block %v, rollover %v: #%v should be %v away; got %v",
+					test.blockNumber, test.rollover, wire, d, actual)
+			}
+		}
+	}
+
+	// the ACK of an OACK or a WRQ is block#0, even with a rollover to 1:
+	if d := blockDistance(0, 1, 1); d != -1 {
+		t.Errorf("ACK#0 should be 1 block before block#1; got %v", d)
+	}
+}
@@ -0,0 +1,140 @@
+package tftp
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+// session holds the state of one transfer with a client, from its request to
+// the last ACK.
+type session struct {
+	sock       *net.UDPConn // session socket, see readPacket
+	clientAddr *net.UDPAddr
+	req        *PacketRequest
+	oack       []Option      // options accepted by the server; no OACK is sent if empty
+	blockSize  int           // size of a full DATA payload, see the blksize option
+	timeout    time.Duration // retransmission timeout, see the timeout option
+	windowSize int           // number of blocks per ACK, see the windowsize option
+	rollover   uint16        // block number after 65535: 0 or 1, see the rollover option
+	multicast  bool          // the client reads the file in a multicast group
+	generated  []byte        // content of a file generated from a template, nil otherwise
+}
+
+// clientAbort is the outcome of a session that the client ended with an ERROR
+// packet. No ERROR is sent back (RFC 1350).
+type clientAbort struct {
+	pkt *PacketError
+}
+
+func (e *clientAbort) Error() string {
+	return fmt.Sprintf("client aborted with error %v: %v", e.pkt.Code, e.pkt.Msg)
+}
+
+// readPacket returns the next packet from the client, or nil if none arrives
+// within timeout. The session socket is not connected: packets from any other
+// address are answered with an "unknown transfer ID" error, and otherwise
+// ignored, and so are invalid packets. Failing to answer them does not end the
+// session.
+func (ses *session) readPacket(buf []byte, timeout time.Duration) (*Packet, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		pkt, addr, err := readPacket(ses.sock, buf, time.Until(deadline))
+		if err != nil {
+			return nil, err
+		}
+		if addr == nil {
+			return nil, nil // timed out
+		}
+		if sameUDPAddr(addr, ses.clientAddr) {
+			if pkt != nil {
+				return pkt, nil
+			}
+			continue
+		}
+		log.Printf("[%v] Ignored: received a packet from %v during a session with %v\n",
+			ses.sock.LocalAddr(), addr, ses.clientAddr)
+		if pkt != nil {
+			if _, ok := (*pkt).(*PacketError); ok {
+				continue // errors are not answered
+			}
+		}
+		pktErr := PacketError{errUnknownTransferId, "Unknown transfer ID"}
+		if _, err = writeBuf(ses.sock, pktErr.Serialize(), addr, ses.timeout); err != nil {
+			log.Printf("[%v] Could not answer %v: %v\n", ses.sock.LocalAddr(), addr, err)
+		}
+	}
+}
+
+// send sends pkt to the client. A write that times out is not an error: the
+// packet is lost, and sent again when its response times out.
+func (ses *session) send(pkt Packet) error {
+	n, err := writeBuf(ses.sock, pkt.Serialize(), ses.clientAddr, ses.timeout)
+	if err != nil {
+		return fmt.Errorf("writing to client: %w", err)
+	}
+	if n == 0 {
+		log.Printf("[%v] Timed out sending %v to %v\n", ses.sock.LocalAddr(), packetString(pkt),
+			ses.clientAddr)
+		return nil
+	}
+	log.Printf("[%v] Sent %v to %v (%vB)\n", ses.sock.LocalAddr(), packetString(pkt), ses.clientAddr, n)
+	return nil
+}
+
+// receive returns the next packet from the client, or nil on timeout.
+func (ses *session) receive(timeout time.Duration) (Packet, error) {
+	pkt, err := ses.readPacket(make([]byte, ses.packetSize()), timeout)
+	if pkt == nil {
+		return nil, err
+	}
+	return *pkt, nil
+}
+
+// netascii tells if the file is transferred in netascii mode, rather than octet.
+func (ses *session) netascii() bool {
+	return strings.EqualFold(ses.req.Mode, "netascii")
+}
+
+// packetSize is the size of the buffer needed to receive this session's
+// DATA packets.
+func (ses *session) packetSize() int {
+	if n := 4 + ses.blockSize; n > MaxPacketSize {
+		return n
+	}
+	return MaxPacketSize
+}
+
+// wireBlockNumber returns the 16-bit block number of the blockNumber'th block
+// of the session.
+func (ses *session) wireBlockNumber(blockNumber uint64) uint16 {
+	return wireBlockNumber(blockNumber, ses.rollover)
+}
+
+// wireBlockNumber returns the 16-bit block number of the blockNumber'th block
+// of a transfer, where block#65535 is followed by block#rollover (0 or 1).
+// With a rollover to 1, block#0 only ever acknowledges a WRQ or an OACK.
+func wireBlockNumber(blockNumber uint64, rollover uint16) uint16 {
+	if blockNumber < uint64(rollover) {
+		return uint16(blockNumber)
+	}
+	period := uint64(1<<16) - uint64(rollover)
+	return uint16((blockNumber-uint64(rollover))%period) + rollover
+}
+
+// blockDistance returns how many blocks the 16-bit block number wire is ahead
+// of the blockNumber'th block of a transfer (negative if it is behind), taking
+// the nearest block that has that number.
+func blockDistance(wire uint16, blockNumber uint64, rollover uint16) int64 {
+	period := int64(1<<16) - int64(rollover)
+	d := (int64(wire) - int64(wireBlockNumber(blockNumber, rollover))) % period
+	if d < 0 {
+		d += period
+	}
+	if d >= period/2 {
+		d -= period
+	}
+	return d
+}
@@ -0,0 +1,49 @@
+package tftp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSessionReadPacket(t *testing.T) {
+	var socks [3]*net.UDPConn // session, client, stray
+	for i := range socks {
+		sock, err := createSessionSocket("127.0.0.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sock.Close()
+		socks[i] = sock
+	}
+	sesAddr := socks[0].LocalAddr().(*net.UDPAddr)
+	ses := &session{sock: socks[0], clientAddr: socks[1].LocalAddr().(*net.UDPAddr),
+		timeout: time.Second}
+
+	// a stray packet is answered with ERROR 5, and the session goes on:
+	stray := PacketAck{1}
+	socks[2].WriteToUDP(stray.Serialize(), sesAddr)
+	ack := PacketAck{2}
+	socks[1].WriteToUDP(ack.Serialize(), sesAddr)
+
+	buf := make([]byte, MaxPacketSize)
+	pkt, err := ses.readPacket(buf, time.Second)
+	if err != nil || pkt == nil {
+		t.Fatal(pkt, err)
+	}
+	if p, ok := (*pkt).(*PacketAck); !ok || p.BlockNum != 2 {
+		t.Error("expected ACK#2 from the client; got", *pkt)
+	}
+	pkt, _, err = readPacket(socks[2], buf, time.Second)
+	if err != nil || pkt == nil {
+		t.Fatal(pkt, err)
+	}
+	if p, ok := (*pkt).(*PacketError); !ok || p.Code != errUnknownTransferId {
+		t.Error("expected ERROR 5 for the stray; got", *pkt)
+	}
+
+	// nothing more from the client:
+	if pkt, err = ses.readPacket(buf, 10*time.Millisecond); pkt != nil || err != nil {
+		t.Error("expected a timeout; got", pkt, err)
+	}
+}
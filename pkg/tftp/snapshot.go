@@ -0,0 +1,142 @@
+package tftp
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// The snapshot of a FileManager is its files, gob encoded: a map of the file
+// names to their snapshotFile. It is written to a temporary file that is renamed
+// over the previous snapshot, so that a crash while saving leaves the previous
+// snapshot intact.
+
+// snapshotFile is a file in a snapshot.
+type snapshotFile struct {
+	Content []byte
+	Meta    Metadata
+	Expires time.Time // zero if the file does not expire
+}
+
+// load restores the files of the snapshot, if there is one.
+func (fm *FileManager) load() error {
+	file, err := os.Open(fm.SnapshotFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil // first start
+	}
+	if err != nil {
+		return fmt.Errorf("loading snapshot: %w", err)
+	}
+	defer file.Close()
+	var files map[string]snapshotFile
+	if err = gob.NewDecoder(file).Decode(&files); err != nil {
+		return fmt.Errorf("loading snapshot %v: %w", fm.SnapshotFile, err)
+	}
+
+	fm.mutex.Lock()
+	defer fm.mutex.Unlock()
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names) // for the same files to be skipped on every load
+	loaded, now := 0, fm.clock()
+	for _, name := range names {
+		file := &memFile{content: files[name].Content, meta: files[name].Meta,
+			expires: files[name].Expires}
+		if file.expired(now) {
+			continue
+		}
+		if err := checkName(name); err != nil {
+			log.Println("Skipped from snapshot:", err)
+			continue
+		}
+		if err := fm.conflict(name); err != nil {
+			log.Println("Skipped from snapshot:", err)
+			continue
+		}
+		if file.content == nil {
+			file.content = []byte{} // gob decodes empty files as nil
+		}
+		if file.meta.SHA256 == "" { // saved without its metadata
+			sha, md := sha256.Sum256(file.content), md5.Sum(file.content)
+			file.meta.SHA256, file.meta.MD5 = hex.EncodeToString(sha[:]), hex.EncodeToString(md[:])
+		}
+		fm.store(name, file)
+		fm.used += int64(len(file.content))
+		loaded++
+	}
+	log.Printf("Loaded %v files from snapshot %v\n", loaded, fm.SnapshotFile)
+	return nil
+}
+
+// save writes the snapshot, unless the files did not change since the last
+// one.
+func (fm *FileManager) save() error {
+	fm.saveMutex.Lock()
+	defer fm.saveMutex.Unlock()
+
+	// The content of the files is never modified in place: a copy of the map
+	// is enough for a consistent snapshot.
+	fm.mutex.RLock()
+	changes := fm.changes
+	files := make(map[string]snapshotFile, len(fm.files))
+	for name, file := range fm.files {
+		files[name] = snapshotFile{file.content, file.meta, file.expires}
+	}
+	fm.mutex.RUnlock()
+	if changes == fm.savedChanges {
+		return nil
+	}
+
+	dir, base := filepath.Split(fm.SnapshotFile)
+	if dir == "" {
+		dir = "."
+	}
+	tmp, err := os.CreateTemp(dir, base+".tmp*")
+	if err != nil {
+		return fmt.Errorf("saving snapshot: %w", err)
+	}
+	defer os.Remove(tmp.Name()) // unless renamed
+	err = gob.NewEncoder(tmp).Encode(files)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if e := tmp.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), fm.SnapshotFile)
+	}
+	if err != nil {
+		return fmt.Errorf("saving snapshot %v: %w", fm.SnapshotFile, err)
+	}
+	fm.savedChanges = changes
+	return nil
+}
+
+// saveLoop saves the snapshot every SnapshotInterval, until stop is closed.
+func (fm *FileManager) saveLoop(stop chan struct{}) {
+	defer fm.loops.Done()
+	ticker := time.NewTicker(fm.SnapshotInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := fm.save(); err != nil {
+				log.Println(err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
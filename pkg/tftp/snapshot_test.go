@@ -0,0 +1,147 @@
+package tftp
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	snapshot := filepath.Join(dir, "files.snapshot")
+
+	fm := FileManager{SnapshotFile: snapshot}
+	if err := fm.Init(); err != nil {
+		t.Fatal("no snapshot yet:", err)
+	}
+	if err := putThenGet(&fm, "f1", "content"); err != nil {
+		t.Error(err)
+	}
+	fm.countDownload("f1")
+	if err := putThenGet(&fm, "empty", ""); err != nil {
+		t.Error(err)
+	}
+	if err := fm.DeInit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a restart restores the files:
+	fm = FileManager{SnapshotFile: snapshot}
+	if err := fm.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := fm.Stat("f1"); info.Size != 7 || err != nil {
+		t.Error(info, err)
+	}
+	if meta, _ := fm.Metadata("f1"); meta.Modified.IsZero() || meta.Downloads != 1 ||
+		meta.SHA256 != "ed7002b439e9ac845f22357d822bac1444730fbdb6016d3ec9432297b9ec9f73" {
+		t.Error("metadata not restored:", meta)
+	}
+	if err := putThenGet(&fm, "empty.1", ""); err != nil {
+		t.Error(err)
+	}
+	if it, err := fm.Get("empty", blockSize); err != nil {
+		t.Error(err)
+	} else if buf, _ := it.Read(); buf != nil {
+		t.Error(buf)
+	}
+	if fm.used != 7 {
+		t.Error("used", fm.used)
+	}
+
+	// an unchanged store is not saved again:
+	before, _ := os.Stat(snapshot)
+	fm.savedChanges = fm.changes
+	if err := fm.DeInit(); err != nil {
+		t.Error(err)
+	}
+	if after, _ := os.Stat(snapshot); !after.ModTime().Equal(before.ModTime()) {
+		t.Error("snapshot saved again")
+	}
+
+	// a corrupt snapshot is reported, rather than served as an empty store:
+	if err := os.WriteFile(snapshot, []byte("garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fm = FileManager{SnapshotFile: snapshot}
+	if err := fm.Init(); err == nil {
+		t.Error("corrupt snapshot loaded")
+	}
+}
+
+func TestSnapshotSave(t *testing.T) {
+	dir := t.TempDir()
+	snapshot := filepath.Join(dir, "files.snapshot")
+	fm := FileManager{SnapshotFile: snapshot, SnapshotInterval: 10 * time.Millisecond}
+	if err := fm.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer fm.DeInit()
+
+	// the snapshot is saved periodically:
+	if err := putThenGet(&fm, "f1", "content"); err != nil {
+		t.Error(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for _, err := os.Stat(snapshot); err != nil; _, err = os.Stat(snapshot) {
+		if time.Now().After(deadline) {
+			t.Fatal("snapshot not saved:", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	restored := FileManager{SnapshotFile: snapshot}
+	if err := restored.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := restored.Stat("f1"); info.Size != 7 || err != nil {
+		t.Error(info, err)
+	}
+
+	// a failed save leaves no temporary file:
+	close(fm.stop)
+	fm.loops.Wait()
+	fm.stop = nil
+	blocked := filepath.Join(dir, "blocked")
+	if err := os.MkdirAll(filepath.Join(blocked, "d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	fm.SnapshotFile = blocked // cannot be renamed over
+	fm.changes++
+	if err := fm.save(); err == nil {
+		t.Error("saved over a directory")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 2 {
+		t.Error(entries)
+	}
+}
+
+func TestSnapshotExpiry(t *testing.T) {
+	snapshot := filepath.Join(t.TempDir(), "files.snapshot")
+	clock := &fakeClock{time.Unix(0, 0)}
+	ttl := func(filename string) time.Duration { return time.Duration(len(filename)) * time.Minute }
+	fm := FileManager{SnapshotFile: snapshot, TTL: ttl, clock: clock.Now}
+	fm.Init()
+	for _, name := range []string{"a", "bbb"} {
+		if err := putThenGet(&fm, name, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fm.DeInit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the files keep their expiry across restarts:
+	clock.now = clock.now.Add(2 * time.Minute)
+	fm = FileManager{SnapshotFile: snapshot, clock: clock.Now}
+	if err := fm.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if fm.Exists("a") || !fm.Exists("bbb") || fm.used != 3 {
+		t.Error(fm.List())
+	}
+	clock.now = clock.now.Add(time.Minute)
+	if fm.Exists("bbb") {
+		t.Error("bbb did not expire")
+	}
+}
@@ -14,10 +14,10 @@ func resolveUDPAddr(localIpAddr string, localPort uint16) (*net.UDPAddr, error)
 	return net.ResolveUDPAddr("udp", sockAddr)
 }
 
-func readPacket(sock *net.UDPConn, buf []byte, timeoutSecond uint) (*Packet, *net.UDPAddr, error) {
-	if err := sock.SetReadDeadline(time.Now().Add(time.Duration(timeoutSecond) * time.Second)); err != nil {
-		return nil, nil, fmt.Errorf("[%v] Could not set read deadline of +%vms on socket: %w",
-			sock.LocalAddr(), timeoutSecond, err)
+func readPacket(sock *net.UDPConn, buf []byte, timeout time.Duration) (*Packet, *net.UDPAddr, error) {
+	if err := sock.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, nil, fmt.Errorf("[%v] Could not set read deadline of +%v on socket: %w",
+			sock.LocalAddr(), timeout, err)
 	}
 	n, addr, err := sock.ReadFromUDP(buf)
 	if err != nil || n <= 0 {
@@ -35,13 +35,13 @@ func readPacket(sock *net.UDPConn, buf []byte, timeoutSecond uint) (*Packet, *ne
 	return &pkt, addr, nil
 }
 
-func writeBuf(sock *net.UDPConn, buf []byte, timeoutSecond uint) (int, error) {
-	if err := sock.SetWriteDeadline(time.Now().Add(time.Duration(timeoutSecond) * time.Second)); err != nil {
-		return 0, fmt.Errorf("[%v] Could not set write deadline of +%vms on socket: %w",
-			sock.LocalAddr(), timeoutSecond, err)
+func writeBuf(sock *net.UDPConn, buf []byte, addr *net.UDPAddr, timeout time.Duration) (int, error) {
+	if err := sock.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
+		return 0, fmt.Errorf("[%v] Could not set write deadline of +%v on socket: %w",
+			sock.LocalAddr(), timeout, err)
 	}
 
-	n, err := sock.Write(buf)
+	n, err := sock.WriteToUDP(buf, addr)
 	if err != nil || n <= 0 {
 		if n == 0 {
 			return 0, nil // timeout
@@ -52,14 +52,69 @@ func writeBuf(sock *net.UDPConn, buf []byte, timeoutSecond uint) (int, error) {
 	}
 }
 
-func createSessionSocket(localInterface string, remoteAddr *net.UDPAddr) (*net.UDPConn, error) {
+// createSessionSocket creates the socket of a session, or of a multicast group.
+// It is not connected to the client: packets from other addresses are received
+// too, so that they can be answered with an "unknown transfer ID" error.
+func createSessionSocket(localInterface string) (*net.UDPConn, error) {
 	if sockAddr, e := resolveUDPAddr(localInterface, 0); e != nil {
 		return nil, fmt.Errorf("Invalid address [%v:0] : %w", localInterface, e) // wrap error
 	} else {
-		if sock, e := net.DialUDP("udp", sockAddr, remoteAddr); e != nil {
+		if sock, e := net.ListenUDP("udp", sockAddr); e != nil {
 			return nil, fmt.Errorf("Session socket %v: %w", sockAddr, e)
 		} else {
 			return sock, nil
 		}
 	}
 }
+
+// sameUDPAddr tells if a and b are the same address and port, whichever the
+// representation of their IPs.
+func sameUDPAddr(a, b *net.UDPAddr) bool {
+	return a.Port == b.Port && a.IP.Equal(b.IP)
+}
+
+// pathBlockSize returns the largest DATA payload that fits in one datagram
+// sent from sock to remoteAddr without IP fragmentation, as far as the MTU of
+// the local interface tells.
+func pathBlockSize(sock *net.UDPConn, remoteAddr *net.UDPAddr) (int, error) {
+	localIP := sock.LocalAddr().(*net.UDPAddr).IP
+	if localIP.IsUnspecified() {
+		// the socket is not bound to an address: ask the routing table which
+		// one it would use to reach the client (no packet is sent):
+		probe, err := net.DialUDP("udp", nil, remoteAddr)
+		if err != nil {
+			return 0, fmt.Errorf("route to %v: %w", remoteAddr, err)
+		}
+		localIP = probe.LocalAddr().(*net.UDPAddr).IP
+		probe.Close()
+	}
+	mtu, err := interfaceMTU(localIP)
+	if err != nil {
+		return 0, err
+	}
+	headers := 20 + 8 + 4 // IPv4 + UDP + TFTP DATA
+	if localIP.To4() == nil {
+		headers = 40 + 8 + 4 // IPv6 + UDP + TFTP DATA
+	}
+	return mtu - headers, nil
+}
+
+// interfaceMTU returns the MTU of the network interface that has the address ip.
+func interfaceMTU(ip net.IP) (int, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return 0, fmt.Errorf("listing interfaces: %w", err)
+	}
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+				return iface.MTU, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("no interface with address %v", ip)
+}
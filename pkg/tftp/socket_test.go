@@ -1 +1,17 @@
 package tftp
+
+import "testing"
+
+func TestPathBlockSize(t *testing.T) {
+	clientAddr, _ := resolveUDPAddr("127.0.0.1", 6969)
+	sock, err := createSessionSocket("0.0.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sock.Close()
+
+	// loopback interfaces have MTUs of at least 1500:
+	if size, err := pathBlockSize(sock, clientAddr); err != nil || size < 1500-32 {
+		t.Error(size, err)
+	}
+}
@@ -0,0 +1,199 @@
+package tftp
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// TemplateRule generates the files whose names match Pattern: each read
+// request renders the Go text/template in the file Template anew, for the
+// client that sent it. Generated files cannot be uploaded.
+type TemplateRule struct {
+	Pattern  string // regular expression that must match the whole file name
+	Template string // path of the template file
+}
+
+// TemplateData is what a template is executed with.
+type TemplateData struct {
+	Client   string            // IP address of the client
+	Port     int               // UDP port of the client
+	Filename string            // file name requested
+	Match    []string          // the file name, and the groups of the pattern
+	Groups   map[string]string // the named groups of the pattern
+	Attrs    map[string]string // inventory entry of the client IP, if any
+}
+
+// generator renders the files of the template rules. A nil generator renders
+// none.
+type generator struct {
+	Rules     []TemplateRule
+	Inventory string // path of the inventory file; "" for none
+
+	rules []compiledRule
+
+	mutex     sync.Mutex                   // protects the inventory below
+	inventory map[string]map[string]string // attributes, by normalized key
+	loaded    time.Time                    // modification time of the inventory loaded
+}
+
+type compiledRule struct {
+	pattern  *regexp.Regexp
+	template *template.Template
+}
+
+// Init compiles the patterns, parses the templates, and loads the inventory:
+// a mistake in either fails the server's start.
+func (g *generator) Init() (err error) {
+	funcs := template.FuncMap{
+		"inventory": g.lookup,
+		"upper":     strings.ToUpper,
+		"lower":     strings.ToLower,
+		"hexip":     hexIP,
+	}
+	g.rules = nil
+	for _, rule := range g.Rules {
+		pattern, err := regexp.Compile("^(?:" + rule.Pattern + ")$")
+		if err != nil {
+			return fmt.Errorf("template pattern %q: %w", rule.Pattern, err)
+		}
+		text, err := os.ReadFile(rule.Template)
+		if err != nil {
+			return fmt.Errorf("template of %q: %w", rule.Pattern, err)
+		}
+		tmpl, err := template.New(rule.Template).Funcs(funcs).Parse(string(text))
+		if err != nil {
+			return fmt.Errorf("template of %q: %w", rule.Pattern, err)
+		}
+		g.rules = append(g.rules, compiledRule{pattern, tmpl})
+	}
+	g.inventory, g.loaded = nil, time.Time{}
+	if g.Inventory != "" {
+		return g.reload()
+	}
+	return nil
+}
+
+// reload loads the inventory file again if it was modified since it was last
+// loaded. The caller holds the mutex, but for Init.
+func (g *generator) reload() error {
+	info, err := os.Stat(g.Inventory)
+	if err != nil {
+		return fmt.Errorf("inventory: %w", err)
+	}
+	if info.ModTime().Equal(g.loaded) {
+		return nil
+	}
+	content, err := os.ReadFile(g.Inventory)
+	if err != nil {
+		return fmt.Errorf("inventory: %w", err)
+	}
+	var entries map[string]map[string]string
+	if err = json.Unmarshal(content, &entries); err != nil {
+		return fmt.Errorf("inventory %v: %w", g.Inventory, err)
+	}
+	g.inventory = make(map[string]map[string]string, len(entries))
+	for key, attrs := range entries {
+		g.inventory[inventoryKey(key)] = attrs
+	}
+	g.loaded = info.ModTime()
+	log.Printf("Loaded inventory %v: %v entries\n", g.Inventory, len(g.inventory))
+	return nil
+}
+
+// inventoryKey normalizes the key of an inventory entry: an IP address in its
+// canonical form, anything else, such as a MAC address, in lower case.
+func inventoryKey(key string) string {
+	if ip := net.ParseIP(key); ip != nil {
+		return ip.String()
+	}
+	return strings.ToLower(key)
+}
+
+// lookup returns the inventory entry of a key, or an empty one. It is the
+// inventory function of the templates.
+func (g *generator) lookup(key string) map[string]string {
+	if attrs, ok := g.inventory[inventoryKey(key)]; ok {
+		return attrs
+	}
+	return map[string]string{}
+}
+
+// hexIP formats an IP address in upper case hexadecimal, as in the
+// configuration file names of PXELINUX: C0A80001 for 192.168.0.1.
+func hexIP(s string) string {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return ""
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return strings.ToUpper(hex.EncodeToString(ip))
+}
+
+// match returns the rule that generates filename, and the submatches of its
+// pattern, or nil if the file is not generated.
+func (g *generator) match(filename string) (*compiledRule, []string) {
+	if g == nil {
+		return nil, nil
+	}
+	for i := range g.rules {
+		if m := g.rules[i].pattern.FindStringSubmatch(filename); m != nil {
+			return &g.rules[i], m
+		}
+	}
+	return nil, nil
+}
+
+// render executes the template of a rule for a client. The content is never
+// nil, even if empty.
+func (g *generator) render(rule *compiledRule, match []string, clientAddr *net.UDPAddr) ([]byte, error) {
+	data := TemplateData{Client: clientAddr.IP.String(), Port: clientAddr.Port, Filename: match[0],
+		Match: match, Groups: make(map[string]string)}
+	for i, name := range rule.pattern.SubexpNames() {
+		if name != "" {
+			data.Groups[name] = match[i]
+		}
+	}
+
+	// The mutex is held until the template is executed, for its inventory
+	// function to read the inventory loaded:
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.Inventory != "" {
+		if err := g.reload(); err != nil {
+			log.Println(err, "- keeping the inventory loaded before")
+		}
+	}
+	data.Attrs = g.lookup(data.Client)
+	content := bytes.NewBuffer([]byte{})
+	if err := rule.template.Execute(content, data); err != nil {
+		return nil, fmt.Errorf("generating %v: %w", data.Filename, err)
+	}
+	return content.Bytes(), nil
+}
+
+// generate renders the requested file if a template rule generates it, into
+// ses.generated, before the options are negotiated: the size of the file is
+// then known. A write request of a generated file is refused.
+func (svr *Server) generate(ses *session) (err error) {
+	rule, match := svr.templates.match(ses.req.Filename)
+	if rule == nil {
+		return nil
+	}
+	if ses.req.Op == OpWRQ {
+		return &PacketError{errAccessViolation, ses.req.Filename + " is generated, it cannot be uploaded"}
+	}
+	ses.generated, err = svr.templates.render(rule, match, ses.clientAddr)
+	return
+}
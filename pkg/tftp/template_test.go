@@ -0,0 +1,122 @@
+package tftp
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestGenerator(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	g := generator{
+		Rules: []TemplateRule{
+			{`pxelinux\.cfg/01-(?P<mac>[0-9a-f-]+)`, write("mac.tmpl",
+				`{{with inventory .Groups.mac}}{{.kernel}}{{end}} {{.Client}}`)},
+			{`pxelinux\.cfg/.*`, write("ip.tmpl",
+				`{{.Filename}} {{hexip .Client}} {{upper .Attrs.host}} {{index .Match 0}}`)},
+			{`empty`, write("empty.tmpl", ``)},
+		},
+		Inventory: write("inventory.json",
+			`{"192.168.0.1": {"host": "pc1"}, "AA-BB-CC-DD-EE-FF": {"kernel": "vmlinuz"}}`),
+	}
+	if err := g.Init(); err != nil {
+		t.Fatal(err)
+	}
+	client := &net.UDPAddr{IP: net.ParseIP("192.168.0.1"), Port: 2000}
+	render := func(filename string) string {
+		rule, match := g.match(filename)
+		if rule == nil {
+			return "not generated"
+		}
+		content, err := g.render(rule, match, client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if content == nil {
+			t.Fatal(filename, "rendered nil")
+		}
+		return string(content)
+	}
+
+	for filename, content := range map[string]string{
+		"pxelinux.cfg/01-aa-bb-cc-dd-ee-ff": "vmlinuz 192.168.0.1",
+		"pxelinux.cfg/C0A80001":             "pxelinux.cfg/C0A80001 C0A80001 PC1 pxelinux.cfg/C0A80001",
+		"empty":                             "",
+		"pxelinux.cfg":                      "not generated",
+		"empty/f":                           "not generated",
+	} {
+		if actual := render(filename); actual != content {
+			t.Errorf("%v: expected %q; got %q", filename, content, actual)
+		}
+	}
+
+	// the inventory is reloaded once modified, and kept if it is not valid:
+	write("inventory.json", `{"192.168.0.1": {"host": "pc2"}}`)
+	os.Chtimes(g.Inventory, time.Now(), time.Now().Add(time.Minute))
+	if actual := render("pxelinux.cfg/default"); actual != "pxelinux.cfg/default C0A80001 PC2 pxelinux.cfg/default" {
+		t.Error(actual)
+	}
+	write("inventory.json", `{`)
+	os.Chtimes(g.Inventory, time.Now(), time.Now().Add(2*time.Minute))
+	if actual := render("pxelinux.cfg/default"); actual != "pxelinux.cfg/default C0A80001 PC2 pxelinux.cfg/default" {
+		t.Error(actual)
+	}
+
+	// invalid rules fail Init:
+	for _, rule := range []TemplateRule{{`(`, g.Rules[0].Template}, {`f`, filepath.Join(dir, "missing")},
+		{`f`, write("invalid.tmpl", `{{.Client`)}} {
+		if err := (&generator{Rules: []TemplateRule{rule}}).Init(); err == nil {
+			t.Error(rule, "accepted")
+		}
+	}
+}
+
+func TestServerGenerate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hello.tmpl")
+	os.WriteFile(path, []byte(`hello {{.Client}}`), 0644)
+	svr := Server{Conf: &Config{}, Files: &FileManager{},
+		templates: &generator{Rules: []TemplateRule{{"hello", path}}}}
+	svr.Conf.Init()
+	svr.Files.Init()
+	if err := svr.templates.Init(); err != nil {
+		t.Fatal(err)
+	}
+	client := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 2000}
+
+	ses := session{clientAddr: client, req: &PacketRequest{OpRRQ, "hello", "octet", nil}}
+	if err := svr.generate(&ses); err != nil || string(ses.generated) != "hello 10.0.0.1" {
+		t.Fatalf("%q %v", ses.generated, err)
+	}
+	if ack, ok, _ := negotiateTransferSize(&svr, &ses, "0"); ack != "14" || !ok {
+		t.Error(ack, ok)
+	}
+	if _, ok, _ := negotiateMulticast(&svr, &ses, ""); ok {
+		t.Error("multicast read of a generated file")
+	}
+	r := newFileReader(ses.generated, 4)
+	read := ""
+	for buf, _ := r.Read(); buf != nil; buf, _ = r.Read() {
+		read += string(buf)
+	}
+	if read != "hello 10.0.0.1" || r.Close() != nil {
+		t.Error(read)
+	}
+
+	ses = session{clientAddr: client, req: &PacketRequest{OpWRQ, "hello", "octet", nil}}
+	if err := svr.generate(&ses); err == nil || asPacketError(err, 0).Code != errAccessViolation {
+		t.Error(err)
+	}
+	ses = session{clientAddr: client, req: &PacketRequest{OpRRQ, "other", "octet", nil}}
+	if err := svr.generate(&ses); err != nil || ses.generated != nil {
+		t.Error(ses.generated, err)
+	}
+}
@@ -0,0 +1,307 @@
+package tftp
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// transferConn is how a transfer exchanges packets with the client: a session,
+// or a fake connection in tests.
+type transferConn interface {
+	send(pkt Packet) error
+	// receive returns the next packet from the client, or nil on timeout.
+	receive(timeout time.Duration) (Packet, error)
+}
+
+// transferState is where a transfer stands.
+type transferState int
+
+const (
+	transferIdle    transferState = iota // nothing sent yet
+	transferWaiting                      // lastSent was sent, waiting for the response
+	transferDone                         // the last block was acknowledged, or received
+	transferFailed                       // aborted by an error, or out of retries
+)
+
+// transfer moves the blocks of a file between the server and a client, for a
+// RRQ or a WRQ, in windows of blocks acknowledged by a single ACK (RFC 7440; a
+// window of one block is the lockstep of RFC 1350).
+//
+// Packets are only retransmitted when the response to them times out, never
+// in reply to a duplicate ACK or DATA: answering duplicates is the Sorcerer's
+// Apprentice Syndrome (RFC 1123, 4.2.3.1), where a single delayed packet
+// doubles the traffic for the rest of the transfer.
+type transfer struct {
+	conn     transferConn
+	logHdr   string
+	state    transferState
+	lastSent []Packet // the packets the client is expected to respond to
+	tries    uint     // how many times lastSent was sent
+	maxTries uint
+
+	timeout    time.Duration
+	blockSize  int
+	windowSize int
+	rollover   uint16
+}
+
+func newTransfer(ses *session, maxTries uint) *transfer {
+	return &transfer{conn: ses, logHdr: fmt.Sprintf("[%v]", ses.sock.LocalAddr()),
+		maxTries: maxTries, timeout: ses.timeout, blockSize: ses.blockSize,
+		windowSize: ses.windowSize, rollover: ses.rollover}
+}
+
+// exchange sends packets, then passes the client's responses to handle until
+// it reports progress. On timeout, handle is called with nil, and the packets
+// are sent again unless it reports progress. The timeout runs from each
+// transmission: the duplicates the client keeps sending do not delay the
+// retransmission.
+func (t *transfer) exchange(packets []Packet, handle func(Packet) (bool, error)) error {
+	t.lastSent, t.tries = packets, 0
+	for {
+		if t.tries == t.maxTries {
+			return t.fail(fmt.Errorf("no response from client after sending %v %v times",
+				packetString(packets[0]), t.maxTries))
+		}
+		for _, pkt := range packets {
+			if err := t.conn.send(pkt); err != nil {
+				return t.fail(err)
+			}
+		}
+		t.tries++
+		t.state = transferWaiting
+
+		deadline := time.Now().Add(t.timeout)
+		for {
+			pkt, err := t.conn.receive(time.Until(deadline))
+			if err != nil {
+				return t.fail(err)
+			}
+			progress, err := handle(pkt)
+			if err != nil {
+				return t.fail(err)
+			}
+			if progress {
+				return nil
+			}
+			if pkt == nil {
+				break // timed out: send again
+			}
+		}
+	}
+}
+
+// fail ends the transfer with err. A *PacketError is sent to the client.
+func (t *transfer) fail(err error) error {
+	t.state = transferFailed
+	var pktErr *PacketError
+	if errors.As(err, &pktErr) {
+		t.conn.send(pktErr)
+	}
+	return err
+}
+
+// send sends the blocks read from reader to the client, after an OACK of the
+// options oack if there are any.
+func (t *transfer) send(reader blockReader, oack []Option) error {
+
+	// The client acknowledges the OACK with ACK#0 before the first data block
+	// is sent:
+	if len(oack) > 0 {
+		err := t.exchange([]Packet{&PacketOAck{oack}}, func(pkt Packet) (bool, error) {
+			if pkt == nil {
+				return false, nil
+			}
+			acked, err := processAckPacket(0, 1, t.rollover, pkt)
+			return acked > 0, err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// Each exchange sends a window of up to t.windowSize blocks, and slides it
+	// past the blocks acknowledged by the client.
+	var window []Packet
+	var lastSentBufLen int
+	eof := false
+	for blockNumber, windowStart := uint64(1), uint64(1); ; {
+
+		// Fill the window with the next buffers of data from the file:
+		for !eof && len(window) < t.windowSize {
+			fileBuf, err := reader.Read()
+			if err != nil {
+				return t.fail(&PacketError{fileErrorCode(err, errAccessViolation), err.Error()})
+			}
+
+			// fileBuf==nil means that there is no more data to be sent ;
+			// However, if the last packet we sent had a payload size equal to the
+			// maximum payload size, then we send an extra empty packet to signify
+			// the end of transmission.
+			// Also: same logic applies for an empty file: we need to send at least
+			// one data packet.
+			if fileBuf == nil {
+				eof = true
+				if lastSentBufLen == t.blockSize || blockNumber == 1 {
+					fileBuf = []byte{}
+				} else {
+					break
+				}
+			}
+			window = append(window, &PacketData{wireBlockNumber(blockNumber, t.rollover), fileBuf})
+			blockNumber++
+
+			// we need to remember how big a payload we just sent:
+			lastSentBufLen = len(fileBuf)
+		}
+		if len(window) == 0 {
+			t.state = transferDone // all blocks were acknowledged
+			return nil
+		}
+
+		// If only part of the window is acknowledged, the client missed the
+		// next block: the window is sent again from there.
+		err := t.exchange(window, func(pkt Packet) (bool, error) {
+			if pkt == nil {
+				return false, nil
+			}
+			acked, err := processAckPacket(windowStart, len(window), t.rollover, pkt)
+			if err != nil || acked == 0 {
+				return false, err // a duplicate or late ACK: ignored
+			}
+			log.Printf("%v Received ACK#%v from client\n", t.logHdr,
+				wireBlockNumber(windowStart+uint64(acked-1), t.rollover))
+			window = window[acked:]
+			windowStart += uint64(acked)
+			return true, nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// receive writes the blocks received from the client to writer. The first
+// window is requested with first: ACK#0, or the OACK. Once the last block is
+// written, commit stores the file: the final ACK tells the client it is.
+func (t *transfer) receive(writer blockWriter, first Packet, commit func() error) error {
+	reply := first
+	for blockNumber := uint64(1); ; {
+
+		// Receive a window, up to the last (short) block of the file. If a
+		// block is missing, or the client stops short of a full window, the
+		// blocks received so far are acknowledged: the client resumes from
+		// there (RFC 7440).
+		var window [][]byte
+		last := false
+		err := t.exchange([]Packet{reply}, func(pkt Packet) (bool, error) {
+			if pkt == nil {
+				return len(window) > 0, nil
+			}
+			expected := blockNumber + uint64(len(window))
+			status, err := processDataPacket(expected, t.windowSize, t.rollover, pkt)
+			if err != nil {
+				return false, err
+			}
+			switch status {
+			case dataInOrder:
+				data := pkt.(*PacketData).Data
+				log.Printf("%v Received data block#%v from client %vB\n", t.logHdr,
+					wireBlockNumber(expected, t.rollover), len(data))
+				window = append(window, data)
+				last = len(data) < t.blockSize
+				return last || len(window) == t.windowSize, nil
+			case dataGap:
+				return len(window) > 0, nil
+			default:
+				return false, nil // a retransmission of a block we already have: ignored
+			}
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, data := range window {
+			if err = writer.Write(data); err != nil {
+				return t.fail(asPacketError(err, fileErrorCode(err, errAccessViolation)))
+			}
+		}
+		blockNumber += uint64(len(window))
+		reply = &PacketAck{wireBlockNumber(blockNumber-1, t.rollover)}
+
+		if last {
+			if err = commit(); err != nil {
+				return t.fail(err)
+			}
+			// the final ACK is sent once: if it is lost, the client times out
+			// with the whole file sent.
+			if err = t.conn.send(reply); err != nil {
+				return t.fail(err)
+			}
+			t.state = transferDone
+			return nil
+		}
+	}
+}
+
+// outcomes of processDataPacket:
+const (
+	dataInOrder   = iota // the expected block
+	dataGap              // a block ahead of the expected one, in the window
+	dataDuplicate        // a block already received
+)
+
+// processDataPacket tells where a packet from the client stands in the window
+// of windowSize blocks expected from block#blockNumber.
+func processDataPacket(blockNumber uint64, windowSize int, rollover uint16,
+	responsePkt Packet) (status int, err error) {
+	switch pkt := responsePkt.(type) {
+	case *PacketData:
+		switch ahead := blockDistance(pkt.BlockNum, blockNumber, rollover); {
+		case ahead == 0:
+			return dataInOrder, nil
+		case ahead > 0 && ahead < int64(windowSize):
+			return dataGap, nil
+		case ahead < 0:
+			return dataDuplicate, nil
+		default:
+			return 0, fmt.Errorf("invalid data packet from client: "+
+				"current block is #%v,client asked for #%v",
+				wireBlockNumber(blockNumber, rollover), pkt.BlockNum)
+		}
+	case *PacketError:
+		return 0, &clientAbort{pkt}
+	default:
+		return 0, fmt.Errorf(
+			"received non data packet after sending ACK#%v: %v",
+			wireBlockNumber(blockNumber-1, rollover), packetString(responsePkt))
+	}
+}
+
+// processAckPacket returns how many packets of the window of windowSize
+// blocks from block#windowStart an ACK acknowledges: 0 for the ACK of an
+// earlier block, a duplicate or a late one.
+func processAckPacket(windowStart uint64, windowSize int, rollover uint16,
+	responsePkt Packet) (acked int, err error) {
+	switch pkt := responsePkt.(type) {
+	case *PacketAck:
+		switch ahead := blockDistance(pkt.BlockNum, windowStart, rollover); {
+		case ahead >= 0 && ahead < int64(windowSize):
+			return int(ahead) + 1, nil
+		case ahead < 0:
+			return 0, nil
+		default:
+			return 0, fmt.Errorf("invalid ACK from client: "+
+				"current block is #%v,client asked for #%v",
+				wireBlockNumber(windowStart, rollover), pkt.BlockNum)
+		}
+	case *PacketError:
+		return 0, &clientAbort{pkt}
+	default:
+		return 0, fmt.Errorf(
+			"received non ACK after sending block #%v: %v",
+			wireBlockNumber(windowStart, rollover), packetString(responsePkt))
+	}
+}
@@ -0,0 +1,401 @@
+package tftp
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestProcessAckPacket(t *testing.T) {
+	tests := []struct {
+		windowStart uint64
+		windowSize  int
+		ack         uint16
+		acked       int
+		err         bool
+	}{
+		{1, 1, 1, 1, false},
+		{1, 1, 0, 0, false},
+		{10, 4, 10, 1, false},
+		{10, 4, 12, 3, false},
+		{10, 4, 13, 4, false},
+		{10, 4, 9, 0, false},
+		{10, 4, 5, 0, false},
+		{10, 4, 14, 0, true},
+		{65534, 4, 1, 4, false}, // rolled over
+		{65536 + 1, 4, 0, 0, false},
+		{1, 4, 65535, 0, false},
+	}
+	for _, test := range tests {
+		var pkt Packet = &PacketAck{test.ack}
+		acked, err := processAckPacket(test.windowStart, test.windowSize, 0, pkt)
+		if acked != test.acked || (err != nil) != test.err {
+			t.Errorf("ACK#%v for window %v+%v: got %v, %v", test.ack,
+				test.windowStart, test.windowSize, acked, err)
+		}
+	}
+
+	var pkt Packet = &PacketData{1, nil}
+	if _, err := processAckPacket(1, 1, 0, pkt); err == nil {
+		t.Error("expected an error for a DATA packet")
+	}
+
+	var abort *clientAbort
+	pkt = &PacketError{errDiskFull, "disk full"}
+	if _, err := processAckPacket(1, 1, 0, pkt); !errors.As(err, &abort) ||
+		abort.pkt.Code != errDiskFull {
+		t.Error("expected the client's error; got", err)
+	}
+}
+
+func TestProcessDataPacket(t *testing.T) {
+	tests := []struct {
+		blockNumber uint64
+		windowSize  int
+		block       uint16
+		status      int
+		err         bool
+	}{
+		{1, 1, 1, dataInOrder, false},
+		{2, 1, 1, dataDuplicate, false},
+		{2, 1, 3, 0, true},
+		{10, 4, 12, dataGap, false},
+		{10, 4, 13, dataGap, false},
+		{10, 4, 14, 0, true},
+		{10, 4, 3, dataDuplicate, false},
+		{65536, 4, 65535, dataDuplicate, false}, // rolled over
+		{65535, 4, 1, dataGap, false},
+	}
+	for _, test := range tests {
+		var pkt Packet = &PacketData{test.block, nil}
+		status, err := processDataPacket(test.blockNumber, test.windowSize, 0, pkt)
+		if status != test.status || (err != nil) != test.err {
+			t.Errorf("DATA#%v expecting #%v in window of %v: got %v, %v", test.block,
+				test.blockNumber, test.windowSize, status, err)
+		}
+	}
+	var abort *clientAbort
+	var pkt Packet = &PacketError{errAccessViolation, "cancelled"}
+	if _, err := processDataPacket(1, 1, 0, pkt); !errors.As(err, &abort) ||
+		abort.pkt.Msg != "cancelled" {
+		t.Error("expected the client's error; got", err)
+	}
+}
+
+// fakeConn connects a transfer to a simulated client: each packet the server
+// sends is passed to the client, and its responses are queued for the server
+// to receive. The packets sent are numbered from 0, and the network can lose,
+// duplicate or delay them, or the responses to them.
+type fakeConn struct {
+	client    func(Packet) []Packet
+	sent      []Packet
+	queue     []Packet // responses, in the order the server receives them
+	delayed   []Packet // responses that arrive after the ones to the next packet
+	timeouts  int
+	lost      map[int]bool // packets lost on the way to the client
+	lostReply map[int]bool // packets whose responses are lost
+	dup       map[int]bool // packets whose responses arrive twice
+	late      map[int]bool // packets whose responses are delayed
+}
+
+func (c *fakeConn) send(pkt Packet) error {
+	i := len(c.sent)
+	c.sent = append(c.sent, pkt)
+	if c.lost[i] {
+		return nil
+	}
+	responses := c.client(pkt)
+	switch {
+	case c.lostReply[i]:
+		return nil
+	case c.dup[i]:
+		responses = append(responses, responses...)
+	case c.late[i]:
+		c.delayed = append(c.delayed, responses...)
+		return nil
+	}
+	c.queue = append(c.queue, responses...)
+	c.queue = append(c.queue, c.delayed...)
+	c.delayed = nil
+	return nil
+}
+
+func (c *fakeConn) receive(timeout time.Duration) (Packet, error) {
+	if len(c.queue) == 0 {
+		c.timeouts++
+		return nil, nil
+	}
+	pkt := c.queue[0]
+	c.queue = c.queue[1:]
+	return pkt, nil
+}
+
+// dataSent counts the DATA packets sent by the server.
+func (c *fakeConn) dataSent() (n int) {
+	for _, pkt := range c.sent {
+		if _, ok := pkt.(*PacketData); ok {
+			n++
+		}
+	}
+	return n
+}
+
+// downloader is a client reading a file, and acknowledging windows of
+// windowSize blocks. Like most clients, it acknowledges a block out of order
+// with the ACK of the last block received in order.
+type downloader struct {
+	blockSize  int
+	windowSize int
+	received   []byte
+	next       uint16 // block expected
+	inWindow   int    // blocks received since the last ACK
+}
+
+func (d *downloader) respond(pkt Packet) []Packet {
+	switch p := pkt.(type) {
+	case *PacketOAck:
+		return []Packet{&PacketAck{0}}
+	case *PacketData:
+		if p.BlockNum != d.next {
+			d.inWindow = 0
+			return []Packet{&PacketAck{d.next - 1}}
+		}
+		d.received = append(d.received, p.Data...)
+		d.next++
+		if d.inWindow++; d.inWindow == d.windowSize || len(p.Data) < d.blockSize {
+			d.inWindow = 0
+			return []Packet{&PacketAck{p.BlockNum}}
+		}
+	}
+	return nil
+}
+
+// uploader is a client writing content, in windows of windowSize blocks.
+type uploader struct {
+	blockSize  int
+	windowSize int
+	content    []byte
+}
+
+func (u *uploader) respond(pkt Packet) []Packet {
+	var acked int
+	switch p := pkt.(type) {
+	case *PacketOAck:
+	case *PacketAck:
+		acked = int(p.BlockNum)
+	default:
+		return nil
+	}
+	var window []Packet
+	for block := acked + 1; len(window) < u.windowSize; block++ {
+		start := (block - 1) * u.blockSize
+		if start > len(u.content) {
+			break
+		}
+		end := start + u.blockSize
+		if end > len(u.content) {
+			end = len(u.content)
+		}
+		window = append(window, &PacketData{uint16(block), u.content[start:end]})
+		if end-start < u.blockSize {
+			break
+		}
+	}
+	return window
+}
+
+// split cuts content in blocks of blockSize bytes.
+func split(content []byte, blockSize int) *blocks {
+	var b blocks
+	for ; len(content) > blockSize; content = content[blockSize:] {
+		b = append(b, content[:blockSize])
+	}
+	if len(content) > 0 {
+		b = append(b, content)
+	}
+	return &b
+}
+
+func testTransfer(conn *fakeConn, windowSize int) *transfer {
+	return &transfer{conn: conn, logHdr: "[test]", maxTries: 3, blockSize: 8,
+		windowSize: windowSize}
+}
+
+// content is 8 full blocks and a short one.
+var content = []byte("0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ!?,;:-+")
+
+func TestTransferSend(t *testing.T) {
+	tests := []struct {
+		name       string
+		windowSize int
+		oack       []Option
+		conn       fakeConn
+		dataSent   int
+	}{
+		{"no loss", 1, nil, fakeConn{}, 9},
+		{"lost DATA", 1, nil, fakeConn{lost: map[int]bool{3: true}}, 10},
+		{"lost ACK", 1, nil, fakeConn{lostReply: map[int]bool{3: true}}, 10},
+		{"duplicate ACK", 1, nil, fakeConn{dup: map[int]bool{3: true}}, 9},
+		// the delayed ACK#4 arrives after the server resent block#4, and after
+		// the ACK of that: it must not trigger yet another block#5.
+		{"delayed ACK", 1, nil, fakeConn{late: map[int]bool{3: true}}, 10},
+		{"OACK", 1, []Option{{"blksize", "8"}}, fakeConn{lost: map[int]bool{0: true}}, 9},
+		{"window", 4, nil, fakeConn{}, 9},
+		{"window, lost DATA", 4, nil, fakeConn{lost: map[int]bool{5: true}}, 12},
+		{"window, duplicate ACK", 4, nil, fakeConn{dup: map[int]bool{3: true}}, 9},
+		{"window, delayed ACK", 4, nil, fakeConn{late: map[int]bool{3: true, 7: true}}, 13},
+	}
+	for _, test := range tests {
+		client := &downloader{blockSize: 8, windowSize: test.windowSize, next: 1}
+		conn := &test.conn
+		conn.client = client.respond
+		tr := testTransfer(conn, test.windowSize)
+		if err := tr.send(split(content, 8), test.oack); err != nil {
+			t.Errorf("%v: %v", test.name, err)
+			continue
+		}
+		if !bytes.Equal(client.received, content) || tr.state != transferDone {
+			t.Errorf("%v: received %q, state %v", test.name, client.received, tr.state)
+		}
+		if n := conn.dataSent(); n != test.dataSent {
+			t.Errorf("%v: sent %v DATA packets, expected %v", test.name, n, test.dataSent)
+		}
+	}
+}
+
+func TestTransferSendFullBlocks(t *testing.T) {
+	// a file of full blocks ends with an empty one:
+	client := &downloader{blockSize: 8, windowSize: 1, next: 1}
+	conn := &fakeConn{client: client.respond}
+	if err := testTransfer(conn, 1).send(split(content[:16], 8), nil); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(client.received, content[:16]) || conn.dataSent() != 3 {
+		t.Errorf("received %q in %v DATA packets", client.received, conn.dataSent())
+	}
+}
+
+func TestTransferSendErrors(t *testing.T) {
+	// no response:
+	conn := &fakeConn{client: func(Packet) []Packet { return nil }}
+	tr := testTransfer(conn, 1)
+	if err := tr.send(split(content, 8), nil); err == nil || tr.state != transferFailed ||
+		len(conn.sent) != 3 {
+		t.Error("expected 3 tries; got", err, len(conn.sent))
+	}
+
+	// the client aborts:
+	var abort *clientAbort
+	conn = &fakeConn{client: func(Packet) []Packet {
+		return []Packet{&PacketError{errDiskFull, "disk full"}}
+	}}
+	tr = testTransfer(conn, 1)
+	if err := tr.send(split(content, 8), nil); !errors.As(err, &abort) ||
+		tr.state != transferFailed || len(conn.sent) != 1 {
+		t.Error("expected the client's error; got", err, len(conn.sent))
+	}
+}
+
+// repeatingConn is a client that keeps resending ACK#0, as a client does
+// when its own timer fires, faster than the server's timeout: the packets
+// lost are only recovered if the server retransmits anyway.
+type repeatingConn struct {
+	sent     []Packet
+	received int
+}
+
+func (c *repeatingConn) send(pkt Packet) error {
+	c.sent = append(c.sent, pkt)
+	return nil
+}
+
+func (c *repeatingConn) receive(timeout time.Duration) (Packet, error) {
+	if timeout <= 0 {
+		return nil, nil
+	}
+	if c.received++; c.received > 10000 {
+		return nil, errors.New("the server never retransmits")
+	}
+	time.Sleep(time.Millisecond)
+	return &PacketAck{0}, nil
+}
+
+func TestTransferSendDuplicates(t *testing.T) {
+	conn := &repeatingConn{}
+	tr := &transfer{conn: conn, logHdr: "[test]", maxTries: 3, timeout: 20 * time.Millisecond,
+		blockSize: 8, windowSize: 1}
+	err := tr.send(split(content, 8), nil)
+	if err == nil || tr.state != transferFailed || len(conn.sent) != 3 {
+		t.Errorf("expected DATA#1 sent 3 times; got %v packets: %v", len(conn.sent), err)
+	}
+}
+
+func noCommit() error {
+	return nil
+}
+
+func TestTransferReceive(t *testing.T) {
+	tests := []struct {
+		name       string
+		windowSize int
+		first      Packet
+		conn       fakeConn
+		acks       int
+	}{
+		{"no loss", 1, &PacketAck{0}, fakeConn{}, 10},
+		{"lost ACK", 1, &PacketAck{0}, fakeConn{lost: map[int]bool{3: true}}, 11},
+		{"lost DATA", 1, &PacketAck{0}, fakeConn{lostReply: map[int]bool{3: true}}, 11},
+		{"duplicate DATA", 1, &PacketAck{0}, fakeConn{dup: map[int]bool{3: true}}, 10},
+		{"delayed DATA", 1, &PacketAck{0}, fakeConn{late: map[int]bool{3: true}}, 11},
+		{"OACK", 1, &PacketOAck{[]Option{{"blksize", "8"}}}, fakeConn{lost: map[int]bool{0: true}}, 11},
+		{"window", 4, &PacketAck{0}, fakeConn{}, 4},
+		{"window, lost ACK", 4, &PacketAck{0}, fakeConn{lost: map[int]bool{1: true}}, 5},
+		{"window, duplicate DATA", 4, &PacketAck{0}, fakeConn{dup: map[int]bool{1: true}}, 4},
+		{"window, delayed DATA", 4, &PacketAck{0}, fakeConn{late: map[int]bool{1: true}}, 5},
+	}
+	for _, test := range tests {
+		client := &uploader{blockSize: 8, windowSize: test.windowSize, content: content}
+		conn := &test.conn
+		conn.client = client.respond
+		tr := testTransfer(conn, test.windowSize)
+		var received blocks
+		if err := tr.receive(&received, test.first, noCommit); err != nil {
+			t.Errorf("%v: %v", test.name, err)
+			continue
+		}
+		if actual := bytes.Join(received, nil); !bytes.Equal(actual, content) ||
+			tr.state != transferDone {
+			t.Errorf("%v: received %q, state %v", test.name, actual, tr.state)
+		}
+		if len(conn.sent) != test.acks {
+			t.Errorf("%v: sent %v packets, expected %v", test.name, len(conn.sent), test.acks)
+		}
+	}
+}
+
+func TestTransferReceiveErrors(t *testing.T) {
+	conn := &fakeConn{client: func(Packet) []Packet { return nil }}
+	tr := testTransfer(conn, 1)
+	if err := tr.receive(&blocks{}, &PacketAck{0}, noCommit); err == nil || tr.state != transferFailed ||
+		len(conn.sent) != 3 {
+		t.Error("expected 3 tries; got", err, len(conn.sent))
+	}
+
+	// DATA too far ahead is refused:
+	conn = &fakeConn{client: func(Packet) []Packet { return []Packet{&PacketData{7, nil}} }}
+	if err := testTransfer(conn, 1).receive(&blocks{}, &PacketAck{0}, noCommit); err == nil {
+		t.Error("expected an error for block#7")
+	}
+
+	// the file cannot be stored: the client gets an ERROR instead of the final ACK.
+	client := &uploader{blockSize: 8, windowSize: 1, content: content}
+	conn = &fakeConn{client: client.respond}
+	err := testTransfer(conn, 1).receive(&blocks{}, &PacketAck{0}, func() error {
+		return &PacketError{errDiskFull, "disk full"}
+	})
+	if pkt, ok := conn.sent[len(conn.sent)-1].(*PacketError); err == nil || !ok ||
+		pkt.Code != errDiskFull || len(conn.sent) != 10 {
+		t.Error("expected ERROR 3 after 9 ACKs; got", err, conn.sent)
+	}
+}
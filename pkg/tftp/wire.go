@@ -6,10 +6,12 @@ import (
 	"errors"
 	"fmt"
 	"strconv"
+	"strings"
 )
 
-// larger than a typical mtu (1500), and largest DATA packet (516).
+// larger than a typical mtu (1500), and largest DATA packet with the default block size (516).
 // may limit the length of filenames in RRQ/WRQs -- RFC1350 doesn't offer a bound for these.
+// Sessions that negotiate a larger block size use larger buffers.
 const MaxPacketSize = 2048
 
 const (
@@ -18,6 +20,7 @@ const (
 	OpData         = 3
 	OpAck          = 4
 	OpError        = 5
+	OpOAck         = 6 // RFC 2347
 )
 
 const (
@@ -29,6 +32,7 @@ const (
 	errUnknownTransferId        = 5
 	errFileAlreadyExists        = 6
 	errNoSuchUser               = 7
+	errOptionNegotiation        = 8 // RFC 2347
 )
 
 // packet is the interface met by all packet structs
@@ -39,11 +43,19 @@ type Packet interface {
 	Serialize() []byte
 }
 
+// Option is a name/value pair appended to a request, or acknowledged in an
+// OACK (RFC 2347).
+type Option struct {
+	Name  string
+	Value string
+}
+
 // PacketRequest represents a request to read or rite a file.
 type PacketRequest struct {
 	Op       uint16 // OpRRQ or OpWRQ
 	Filename string
 	Mode     string
+	Options  []Option // in the order the client sent them; nil if none
 }
 
 func op2str(op uint16) string {
@@ -58,13 +70,24 @@ func op2str(op uint16) string {
 		return "ACK"
 	case OpError:
 		return "ERR"
+	case OpOAck:
+		return "OAK"
 	default:
 		return strconv.Itoa(int(op))
 	}
 }
 
 func (p *PacketRequest) String() string {
-	return fmt.Sprintf("{%v file=%v mode=%v}", op2str(p.Op), p.Filename, p.Mode)
+	return fmt.Sprintf("{%v file=%v mode=%v%v}", op2str(p.Op), p.Filename, p.Mode,
+		optionsString(p.Options))
+}
+
+func optionsString(options []Option) string {
+	var b strings.Builder
+	for _, o := range options {
+		fmt.Fprintf(&b, " %v=%v", o.Name, o.Value)
+	}
+	return b.String()
 }
 
 func (p *PacketRequest) Parse(buf []byte) (err error) {
@@ -77,15 +100,38 @@ func (p *PacketRequest) Parse(buf []byte) (err error) {
 	if p.Mode, buf, err = parseString(buf); err != nil {
 		return err
 	}
-	return nil
+	p.Options, err = parseOptions(buf)
+	return err
 }
 
 func (p *PacketRequest) Serialize() []byte {
-	buf := make([]byte, 2+len(p.Filename)+1+len(p.Mode)+1)
+	n := 2 + len(p.Filename) + 1 + len(p.Mode) + 1
+	buf := make([]byte, n, n+optionsLen(p.Options))
 	binary.BigEndian.PutUint16(buf, p.Op)
 	copy(buf[2:], p.Filename)
 	copy(buf[2+len(p.Filename)+1:], p.Mode)
-	return buf
+	return appendOptions(buf, p.Options)
+}
+
+// PacketOAck acknowledges the options of a request that the server accepted (RFC 2347).
+type PacketOAck struct {
+	Options []Option
+}
+
+func (p *PacketOAck) String() string {
+	return fmt.Sprintf("{%v%v}", op2str(OpOAck), optionsString(p.Options))
+}
+
+func (p *PacketOAck) Parse(buf []byte) (err error) {
+	buf = buf[2:] // skip over op
+	p.Options, err = parseOptions(buf)
+	return err
+}
+
+func (p *PacketOAck) Serialize() []byte {
+	buf := make([]byte, 2, 2+optionsLen(p.Options))
+	binary.BigEndian.PutUint16(buf, OpOAck)
+	return appendOptions(buf, p.Options)
 }
 
 // PacketData carries a block of data in a file transmission.
@@ -137,6 +183,12 @@ type PacketError struct {
 	Msg  string
 }
 
+// Error makes a PacketError usable as a Go error: functions that fail with a
+// *PacketError expect it to be sent to the client.
+func (p *PacketError) Error() string {
+	return fmt.Sprintf("%v (error %v)", p.Msg, p.Code)
+}
+
 func (p *PacketError) Parse(buf []byte) (err error) {
 	buf = buf[2:] // skip over op
 	if p.Code, buf, err = parseUint16(buf); err != nil {
@@ -175,6 +227,40 @@ func parseString(buf []byte) (string, []byte, error) {
 	return string(buf[:i]), buf[i+1:], nil
 }
 
+// parseOptions reads the null-terminated name/value pairs that end a request
+// or an OACK. It returns nil if buf is empty. The NUL bytes some clients pad
+// their requests with after the last option are ignored.
+func parseOptions(buf []byte) (options []Option, err error) {
+	for len(bytes.Trim(buf, "\x00")) > 0 {
+		var o Option
+		if o.Name, buf, err = parseString(buf); err != nil {
+			return nil, err
+		}
+		if o.Value, buf, err = parseString(buf); err != nil {
+			return nil, err
+		}
+		options = append(options, o)
+	}
+	return options, nil
+}
+
+// optionsLen is the length of the wire representation of options.
+func optionsLen(options []Option) (n int) {
+	for _, o := range options {
+		n += len(o.Name) + 1 + len(o.Value) + 1
+	}
+	return n
+}
+
+// appendOptions appends the wire representation of options to buf.
+func appendOptions(buf []byte, options []Option) []byte {
+	for _, o := range options {
+		buf = append(append(buf, o.Name...), 0)
+		buf = append(append(buf, o.Value...), 0)
+	}
+	return buf
+}
+
 // ParsePacket parses a packet from its wire representation.
 func ParsePacket(buf []byte) (p Packet, err error) {
 	var opcode uint16
@@ -190,6 +276,8 @@ func ParsePacket(buf []byte) (p Packet, err error) {
 		p = &PacketAck{}
 	case OpError:
 		p = &PacketError{}
+	case OpOAck:
+		p = &PacketOAck{}
 	default:
 		err = fmt.Errorf("unexpected opcode %d", opcode)
 		return
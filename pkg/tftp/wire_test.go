@@ -12,11 +12,23 @@ func TestSerializationDeserialization(t *testing.T) {
 	}{
 		{
 			[]byte("\x00\x01foo\x00bar\x00"),
-			&PacketRequest{OpRRQ, "foo", "bar"},
+			&PacketRequest{OpRRQ, "foo", "bar", nil},
 		},
 		{
 			[]byte("\x00\x02foo\x00bar\x00"),
-			&PacketRequest{OpWRQ, "foo", "bar"},
+			&PacketRequest{OpWRQ, "foo", "bar", nil},
+		},
+		{
+			[]byte("\x00\x01foo\x00octet\x00blksize\x001428\x00tsize\x000\x00"),
+			&PacketRequest{OpRRQ, "foo", "octet", []Option{{"blksize", "1428"}, {"tsize", "0"}}},
+		},
+		{
+			[]byte("\x00\x06blksize\x001428\x00"),
+			&PacketOAck{[]Option{{"blksize", "1428"}}},
+		},
+		{
+			[]byte("\x00\x06"),
+			&PacketOAck{},
 		},
 		{
 			[]byte("\x00\x03\x12\x34fnord"),
@@ -58,7 +70,7 @@ func TestDeserializationInvalid(t *testing.T) {
 
 		// invalid opcode
 		[]byte("\x00\x00"),
-		[]byte("\x00\x06"),
+		[]byte("\x00\x07"),
 		[]byte("\xff\x01"),
 		[]byte("\xff\xff"),
 
@@ -74,6 +86,12 @@ func TestDeserializationInvalid(t *testing.T) {
 		[]byte("\x00\x02foo\x00"),
 		[]byte("\x00\x02foo\x00bar"),
 
+		// option without a value
+		[]byte("\x00\x01foo\x00bar\x00blksize"),
+		[]byte("\x00\x01foo\x00bar\x00blksize\x00"),
+		[]byte("\x00\x01foo\x00bar\x00blksize\x001428"),
+		[]byte("\x00\x06tsize\x00"),
+
 		// short data
 		[]byte("\x00\x03"),
 		[]byte("\x00\x03\x01"),
@@ -95,3 +113,18 @@ func TestDeserializationInvalid(t *testing.T) {
 		}
 	}
 }
+
+func TestRequestPadding(t *testing.T) {
+	for _, test := range []string{"\x00\x01foo\x00octet\x00\x00\x00",
+		"\x00\x01foo\x00octet\x00blksize\x001428\x00\x00\x00\x00"} {
+		p, err := ParsePacket([]byte(test))
+		if err != nil {
+			t.Errorf("Parsing packet %q: %v", test, err)
+			continue
+		}
+		if req := p.(*PacketRequest); req.Filename != "foo" || len(req.Options) > 1 ||
+			len(req.Options) == 1 && req.Options[0] != (Option{"blksize", "1428"}) {
+			t.Errorf("Parsing packet %q: got %#v", test, req)
+		}
+	}
+}